@@ -1,34 +1,298 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"emenv"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+// Exit codes, so that scripts can tell failures apart
+const (
+	exitFailure     = 1
+	exitUsage       = 2
+	exitConfig      = 3
+	exitResolution  = 4
+	exitFetch       = 5
+	exitLocked      = 6
+	exitInterrupted = 130
+)
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// unformattedError reports a file which emenv fmt --check would change.
+type unformattedError string
+
+func (e unformattedError) Error() string {
+	return fmt.Sprintf("%s is not formatted", string(e))
+}
+
+// classify tells which exit code err calls for, along with a hint to
+// show the user when there is one.
+func classify(err error) (int, string) {
+
+	var (
+		verr emenv.ValidationError
+		serr *emenv.SyntaxError
+		oerr *emenv.OptionError
+		cerr *emenv.ConfigNotFound
+		uerr usageError
+		nerr unformattedError
+		off  *emenv.OfflineError
+		perr *emenv.PackageNotFound
+		rerr *emenv.RepositoryNotFound
+		merr *emenv.MissingCredentials
+		ferr *emenv.FetchError
+		herr *emenv.StatusError
+		gerr *emenv.GitCommandError
+		lerr *emenv.Locked
+		xerr *emenv.ResolutionConflict
+		aerr *emenv.ResolutionAborted
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted, ""
+	case errors.As(err, &uerr):
+		return exitUsage, ""
+	case errors.As(err, &nerr):
+		return exitFailure, "run emenv fmt to format it"
+	case errors.As(err, &verr), errors.As(err, &serr), errors.As(err, &oerr):
+		return exitConfig, ""
+	case errors.As(err, &cerr):
+		return exitConfig, "create one, or point to it with -c"
+	case errors.As(err, &off):
+		return exitFetch, "sync while online, or drop -offline"
+	case errors.As(err, &perr):
+		return exitResolution, "check its name, or run emenv sync to refresh the archives"
+	case errors.As(err, &rerr):
+		return exitResolution, "declare it with a (source ...) directive"
+	case errors.As(err, &xerr):
+		return exitResolution, "relax the (version ...) options, or take the package from another source"
+	case errors.As(err, &aerr):
+		return exitResolution, "pin some packages with (version ...) options to narrow the search"
+	case errors.As(err, &merr):
+		return exitFetch, "check the (auth ...) option of the source"
+	case errors.As(err, &ferr), errors.As(err, &herr), errors.As(err, &gerr):
+		return exitFetch, ""
+	case errors.As(err, &lerr):
+		return exitLocked, "pass -wait to wait until it is done"
+	}
+	return exitFailure, ""
+}
+
+// fail reports err and exits with the matching code.
+func fail(err error) {
+
+	code, hint := classify(err)
+	var verr emenv.ValidationError
+	switch {
+	case code == exitInterrupted:
+		fmt.Fprintln(os.Stderr, "interrupted")
+	case errors.As(err, &verr):
+		for _, p := range verr.Problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "emenv: %s\n", err)
+	}
+	if len(hint) > 0 {
+		fmt.Fprintf(os.Stderr, "hint: %s\n", hint)
+	}
+	os.Exit(code)
+}
+
+func formatConfig(path string, args []string) error {
+
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "only check whether the file is formatted")
+	flags.Parse(args)
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, err := emenv.FormatConfig(body)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(body, out) {
+		return nil
+	}
+	if *check {
+		return unformattedError(path)
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+func manageCache(cache emenv.Cache, args []string) error {
+
+	flags := flag.NewFlagSet("cache", flag.ExitOnError)
+	max := flags.String("max", "", "size to prune the cache down to")
+	if len(args) == 0 {
+		return usageError("usage: emenv cache ls|prune|clear")
+	}
+	flags.Parse(args[1:])
+
+	switch {
+	case args[0] == "ls":
+		entries, err := cache.Entries()
+		if err != nil {
+			return err
+		}
+		total := int64(0)
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			fmt.Printf("%s %10d %s\n", e.Hash[:12], e.Size, e.URL)
+			if !seen[e.Hash] {
+				total += e.Size
+			}
+			seen[e.Hash] = true
+		}
+		fmt.Printf("%d entries, %d bytes in %s\n", len(entries), total, cache.Dir)
+	case args[0] == "prune":
+		limit := cache.MaxSize
+		if len(*max) > 0 {
+			size, err := emenv.ParseSize(*max)
+			if err != nil {
+				return err
+			}
+			limit = size
+		}
+		evicted, err := cache.Prune(limit)
+		if err != nil {
+			return err
+		}
+		for _, e := range evicted {
+			fmt.Printf("evicted %s\n", e.URL)
+		}
+	case args[0] == "clear":
+		return cache.Clear()
+	default:
+		return usageError(fmt.Sprintf("unknown cache command: %s", args[0]))
+	}
+	return nil
+}
+
+func serve(ctx context.Context, env *emenv.Env, args []string) error {
+
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", emenv.DefaultServeAddr, "address to listen on")
+	private := flags.Bool("private", false, "also serve sources which require authentication")
+	flags.Parse(args)
+	env.Options.ServePrivate = *private
+
+	return env.ServeContext(ctx, *addr)
+}
+
+func bundle(ctx context.Context, env *emenv.Env, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("usage: emenv bundle out.tar.gz")
+	}
+	return env.BundleContext(ctx, args[0])
+}
+
 func main() {
 
-	cfg := flag.String("c", os.ExpandEnv("${PWD}/Emenv"), "configuration path")
+	cfg := flag.String("c", "", "configuration path, looked up from the current directory by default")
+	dir := flag.String("d", os.Getenv("EMENV_HOME"), "base directory of the environment")
 	yes := flag.Bool("y", false, "implicitly answer yes")
+	profile := flag.String("p", os.Getenv("EMENV_PROFILE"), "comma-separated profiles to apply")
+	offline := flag.Bool("offline", false, "never access the network")
+	timeout := flag.Duration("timeout", emenv.DefaultTimeout, "timeout of each HTTP request")
+	retries := flag.Int("retries", emenv.DefaultRetries, "how many times failing HTTP requests are retried")
+	cabundle := flag.String("ca-bundle", os.Getenv("EMENV_CA_BUNDLE"), "additional CA certificates, in PEM format")
+	wait := flag.Duration("wait", 0, "how long to wait for another run on the environment, -1s waiting indefinitely")
 	flag.Parse()
 
-	env, err := emenv.LoadEnv(*cfg, emenv.Options{ImplicitYes: *yes})
-	if err != nil {
-		panic(err)
+	opts := emenv.Options{ImplicitYes: *yes, BaseDir: *dir, Offline: *offline,
+		Timeout: *timeout, Retries: *retries, CABundle: *cabundle, LockWait: *wait,
+		Observer: emenv.NewTextRenderer(os.Stdout), Prompter: emenv.NewTextPrompter(os.Stdin, os.Stdout)}
+	if cdir := os.Getenv("EMENV_CACHE_DIR"); len(cdir) > 0 {
+		opts.CacheDir = cdir
+	} else {
+		opts.CacheDir = emenv.CacheHome()
+	}
+	opts.CacheSize = emenv.DefaultCacheSize
+	if csize := os.Getenv("EMENV_CACHE_SIZE"); len(csize) > 0 {
+		size, err := emenv.ParseSize(csize)
+		if err != nil {
+			fail(err)
+		}
+		opts.CacheSize = size
 	}
+	if len(*profile) > 0 {
+		opts.Profiles = strings.Split(*profile, ",")
+	}
+
+	configPath := func() string {
+		if len(*cfg) > 0 {
+			return *cfg
+		}
+		path, err := emenv.FindConfig(".")
+		if err != nil {
+			fail(err)
+		}
+		return path
+	}
+
+	loadEnv := func() *emenv.Env {
+		env, err := emenv.LoadEnv(configPath(), opts)
+		if err != nil {
+			fail(err)
+		}
+		for _, p := range env.Warnings {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return env
+	}
+
+	// Interrupting stops the command cleanly, a second interrupt
+	// kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
+	var err error
 	switch {
 	case flag.Arg(0) == "sync":
-		err = env.Sync()
+		err = loadEnv().SyncContext(ctx)
 	case flag.Arg(0) == "install":
-		err = env.Install()
+		flags := flag.NewFlagSet("install", flag.ExitOnError)
+		from := flags.String("from-bundle", "", "install from a bundle, without network access")
+		update := flags.Bool("update", false, "move git packages to the current commit of their ref")
+		flags.Parse(flag.Args()[1:])
+		opts.Bundle = *from
+		opts.Update = *update
+		err = loadEnv().InstallContext(ctx)
+	case flag.Arg(0) == "bundle":
+		err = bundle(ctx, loadEnv(), flag.Args()[1:])
+	case flag.Arg(0) == "check":
+		loadEnv()
+	case flag.Arg(0) == "serve":
+		err = serve(ctx, loadEnv(), flag.Args()[1:])
+	case flag.Arg(0) == "cache":
+		err = manageCache(emenv.NewCache(opts.CacheDir, opts.CacheSize), flag.Args()[1:])
+	case flag.Arg(0) == "fmt":
+		err = formatConfig(configPath(), flag.Args()[1:])
 	default:
-		fmt.Printf("unknown command: %s\n", flag.Arg(0))
-		os.Exit(1)
+		err = usageError(fmt.Sprintf("unknown command: %s", flag.Arg(0)))
 	}
 	if err != nil {
-		panic(err)
+		fail(err)
 	}
 	os.Exit(0)
 }
@@ -0,0 +1,213 @@
+package emenv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SourceAuth describes how to authenticate to a private source.
+// Only where credentials live is recorded: they are read from the
+// netrc file or the environment when a request is made.
+type SourceAuth struct {
+	Netrc     bool
+	BearerEnv string
+	CertFile  string
+	KeyFile   string
+}
+
+type NetrcEntry struct {
+	Machine  string
+	Login    string
+	Password string
+}
+
+// NetrcPath is the netrc file credentials are looked up in: $NETRC,
+// or ~/.netrc.
+func NetrcPath() string {
+	if path := os.Getenv("NETRC"); len(path) > 0 {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".netrc")
+}
+
+// ReadNetrc parses a netrc file. The default entry, if any, has an
+// empty Machine.
+func ReadNetrc(path string) ([]NetrcEntry, error) {
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]NetrcEntry, 0)
+	var entry *NetrcEntry
+	inMacro := false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Macro definitions run until the next blank line
+		if inMacro {
+			inMacro = len(fields) > 0
+			continue
+		}
+		for i := 0; i < len(fields); i++ {
+			next := ""
+			if i+1 < len(fields) {
+				next = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				entries = append(entries, NetrcEntry{Machine: next})
+				entry = &entries[len(entries)-1]
+				i++
+			case "default":
+				entries = append(entries, NetrcEntry{})
+				entry = &entries[len(entries)-1]
+			case "login", "password", "account":
+				if entry != nil && fields[i] == "login" {
+					entry.Login = next
+				}
+				if entry != nil && fields[i] == "password" {
+					entry.Password = next
+				}
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// NetrcCredentials finds the login and password for host, falling
+// back on the default entry.
+func NetrcCredentials(path string, host string) (NetrcEntry, bool, error) {
+
+	entries, err := ReadNetrc(path)
+	if err != nil {
+		return NetrcEntry{}, false, err
+	}
+	var fallback *NetrcEntry
+	for i, e := range entries {
+		switch {
+		case e.Machine == host:
+			return e, true, nil
+		case e.Machine == "" && fallback == nil:
+			fallback = &entries[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true, nil
+	}
+	return NetrcEntry{}, false, nil
+}
+
+// AuthFor returns the credentials to present when fetching rawurl
+// for src. They are only sent to the host of the primary URL, never
+// to mirrors run by third parties.
+func (src Source) AuthFor(rawurl string) *SourceAuth {
+	if src.Auth == nil {
+		return nil
+	}
+	primary, err := url.Parse(src.URL)
+	if err != nil {
+		return nil
+	}
+	target, err := url.Parse(rawurl)
+	if err != nil || target.Host != primary.Host || target.Scheme != primary.Scheme {
+		return nil
+	}
+	return src.Auth
+}
+
+// Authorize adds the credentials of auth to a request.
+func (auth *SourceAuth) Authorize(req *http.Request) error {
+
+	if auth == nil {
+		return nil
+	}
+	if auth.Netrc {
+		entry, ok, err := NetrcCredentials(NetrcPath(), req.URL.Hostname())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return MissingCredentialsError(fmt.Sprintf("no entry for %s in %s", req.URL.Hostname(), NetrcPath()))
+		}
+		req.SetBasicAuth(entry.Login, entry.Password)
+	}
+	if len(auth.BearerEnv) > 0 {
+		token := os.Getenv(auth.BearerEnv)
+		if len(token) == 0 {
+			return MissingCredentialsError(fmt.Sprintf("%s is not set", auth.BearerEnv))
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// AuthOption reads an (auth …) option of a source: (auth netrc),
+// (auth bearer-env "VAR") or (auth tls-cert "cert.pem" "key.pem").
+func AuthOption(auth *SourceAuth) Option {
+	return Option{Name: "auth", MinArgs: 1, MaxArgs: 3, Apply: func(args []Node) error {
+		kind, err := NameArg(args[0])
+		if err != nil {
+			return err
+		}
+		expect := func(n int) error {
+			if len(args)-1 != n {
+				return &OptionError{Pos: args[0].Pos,
+					Reason: fmt.Sprintf("%s expects %d arguments, got %d", kind, n, len(args)-1)}
+			}
+			return nil
+		}
+		switch kind {
+		case "netrc":
+			if err := expect(0); err != nil {
+				return err
+			}
+			auth.Netrc = true
+		case "bearer-env":
+			if err := expect(1); err != nil {
+				return err
+			}
+			auth.BearerEnv, err = NameArg(args[1])
+			return err
+		case "tls-cert":
+			if err := expect(2); err != nil {
+				return err
+			}
+			for i, file := range []*string{&auth.CertFile, &auth.KeyFile} {
+				path, err := StringArg(args[i+1])
+				if err != nil {
+					return err
+				}
+				if *file, err = ResolvePath(args[i+1].Pos, path); err != nil {
+					return err
+				}
+			}
+		default:
+			return &OptionError{Pos: args[0].Pos,
+				Reason: fmt.Sprintf("unknown authentication %s, expected netrc, bearer-env or tls-cert", kind)}
+		}
+		return nil
+	}}
+}
+
+// Redact hides the password a URL may carry, so that it can be shown
+// or stored.
+func Redact(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	return u.Redacted()
+}
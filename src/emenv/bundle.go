@@ -0,0 +1,291 @@
+package emenv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A bundle is a gzipped tar holding plist.el and, for each repository
+// packages were resolved from, a directory laid out as an ELPA archive
+// listing only the bundled packages:
+//
+//   plist.el
+//   melpa/archive-contents
+//   melpa/dash-2.19.1.el
+//   git/foo-1.3.tar
+
+// ArchiveEntry renders the archive-contents entry of a package.
+func ArchiveEntry(pkg Package, kind string) Node {
+
+	deps := make([]Node, 0)
+	for _, dep := range pkg.Dependencies {
+		deps = append(deps, NewList(NewSymbol(dep.Name), versionNode(dep.Version)))
+	}
+	reqs := NewList(deps...)
+	if len(deps) == 0 {
+		reqs = Node{Type: NilNode}
+	}
+	return NewList(NewSymbol(pkg.Name), NewDot(), NewVector(
+		versionNode(pkg.Version), reqs, NewString(pkg.Desc), NewSymbol(kind)))
+}
+
+func versionNode(version Version) Node {
+	members := make([]Node, 0)
+	for _, m := range version.Members {
+		members = append(members, NewNumber(m))
+	}
+	return NewList(members...)
+}
+
+// bundleArtifact returns the contents of a resolved package in a form
+// an archive can serve, with the kind archive-contents records for it.
+func (env *Env) bundleArtifact(ctx context.Context, idef InstallDef) ([]byte, string, error) {
+
+	switch {
+	case idef.StoreType == FileStorage:
+		body, err := env.DownloadPackageContext(ctx, idef)
+		return body, "single", err
+	case idef.StoreType == TarStorage:
+		body, err := env.DownloadPackageContext(ctx, idef)
+		return body, "tar", err
+	case idef.StoreType == GitStorage:
+		body, err := env.GitArchiveContext(ctx, idef)
+		return body, "tar", err
+	case idef.StoreType == LinkStorage:
+		body, err := TarDirectory(idef.Path, fmt.Sprintf("%s-%s/", idef.Name, idef.Version))
+		return body, "tar", err
+	}
+	return nil, "", UnreachableError
+}
+
+// TarDirectory packs the files of dir under prefix, leaving version
+// control directories out.
+func TarDirectory(dir string, prefix string) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix + filepath.ToSlash(rel)
+		switch {
+		case info.IsDir() && (info.Name() == ".git" || info.Name() == ".hg"):
+			return filepath.SkipDir
+		case info.IsDir():
+			return w.WriteHeader(&tar.Header{Name: strings.TrimSuffix(name, ".") + "/",
+				Typeflag: tar.TypeDir, Mode: 0755})
+		case info.Mode().IsRegular():
+			body, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}
+			if err := w.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err = w.Write(body)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTarFile(w *tar.Writer, name string, body []byte) error {
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// Bundle resolves the environment and packs everything needed to
+// install it on a host without network access into out.
+func (env *Env) Bundle(out string) error {
+	return env.BundleContext(context.Background(), out)
+}
+
+// BundleContext writes the bundle of the environment to out, giving
+// up when ctx is done. Nothing is written unless the bundle is
+// complete.
+func (env *Env) BundleContext(ctx context.Context, out string) error {
+
+	lock, err := env.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	defer env.pruneCache()
+
+	if err := env.LoadRepositoriesContext(ctx); err != nil {
+		return err
+	}
+	env.loadPreviousPackages()
+	if err := env.ResolveInstallSetContext(ctx); err != nil {
+		if len(env.Unavailable) > 0 {
+			return &OfflineError{Missing: env.Unavailable, Cause: err}
+		}
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	w := tar.NewWriter(zw)
+
+	archives := make(map[string][]Node)
+	plist := make([]Node, 0)
+	for _, idef := range env.SortedInstallDefs() {
+		if idef.Type == ProvidedPackage {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		body, kind, err := env.bundleArtifact(ctx, idef)
+		if err != nil {
+			return err
+		}
+		suffix := map[string]string{"single": "el", "tar": "tar"}[kind]
+		name := fmt.Sprintf("%s/%s-%s.%s", idef.Repo, idef.Name, idef.Version, suffix)
+		env.notify(BundleAdded{File: name})
+		if err := writeTarFile(w, name, body); err != nil {
+			return err
+		}
+		entry := ArchiveEntry(env.InstallSet.Resolved[idef.Name], kind)
+		archives[idef.Repo] = append(archives[idef.Repo], entry)
+		plist = append(plist, PackageListEntry(idef))
+	}
+
+	repos := make([]string, 0)
+	for repo := range archives {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		contents := NewList(append([]Node{NewNumber(1)}, archives[repo]...)...)
+		body := []byte(PrettyPrintNode(contents, DefaultWidth) + "\n")
+		if err := writeTarFile(w, repo+"/archive-contents", body); err != nil {
+			return err
+		}
+	}
+	body := []byte(PrettyPrintNode(NewList(plist...), DefaultWidth) + "\n")
+	if err := writeTarFile(w, "plist.el", body); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	env.notify(BundleWritten{Path: out, Packages: len(plist)})
+	return writeFileAtomic(out, buf.Bytes())
+}
+
+// ExtractBundle unpacks a bundle into dir, which is emptied first.
+func ExtractBundle(path string, dir string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return BadBundleError(path, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	r := tar.NewReader(zr)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return BadBundleError(path, err)
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return BadBundleError(path, fmt.Errorf("unsafe entry %s", hdr.Name))
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		dest := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		body, err := ReadTarEntry(hdr, r)
+		if err != nil {
+			return BadBundleError(path, err)
+		}
+		if err := ioutil.WriteFile(dest, body, 0644); err != nil {
+			return err
+		}
+	}
+	return UnreachableError
+}
+
+// UseBundle makes the environment resolve from a bundle only: its
+// sources are replaced by the archives of the bundle, each package
+// is taken from the archive it was bundled from, and the network is
+// never accessed.
+func (env *Env) UseBundle(path string) error {
+
+	dir := filepath.Join(env.BaseDir, "bundle")
+	env.notify(BundleExtracting{Path: path})
+	if err := ExtractBundle(path, dir); err != nil {
+		return err
+	}
+	bundled, err := ReadPackageList(filepath.Join(dir, "plist.el"))
+	if err != nil {
+		return BadBundleError(path, err)
+	}
+
+	env.Sources = make(map[string]Source)
+	env.Prefer = make([]string, 0)
+	for _, idef := range bundled {
+		if _, ok := env.Sources[idef.Repo]; !ok {
+			env.Sources[idef.Repo] = Source{Name: idef.Repo, URL: filepath.Join(dir, idef.Repo)}
+			env.Prefer = append(env.Prefer, idef.Repo)
+		}
+	}
+	sort.Strings(env.Prefer)
+
+	for i, pdef := range env.Packages {
+		pdef.Path, pdef.Git, pdef.Ref, pdef.Recipe = "", "", "", nil
+		pdef.Repo = bundled[pdef.Name].Repo
+		env.Packages[i] = pdef
+	}
+
+	// Archives synced earlier must not shadow the bundled ones
+	env.ArchiveDir = filepath.Join(dir, "archives")
+	env.Options.Offline = true
+	env.Client.Offline = true
+	return os.MkdirAll(env.ArchiveDir, 0755)
+}
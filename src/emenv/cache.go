@@ -0,0 +1,234 @@
+package emenv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCacheSize bounds the shared download cache unless
+// configured otherwise.
+const DefaultCacheSize = 1 << 30
+
+// A Cache stores downloaded artifacts shared by every environment of
+// a user. Contents live under blobs/, named after their SHA-256, and
+// urls/ maps the hash of each URL to the blob it was fetched as.
+type Cache struct {
+	Dir     string
+	MaxSize int64
+}
+
+type CacheEntry struct {
+	URL   string
+	Hash  string
+	Size  int64
+	Used  time.Time
+	index string
+}
+
+// CacheHome is the default location of the download cache,
+// following the XDG base directory specification.
+func CacheHome() string {
+	return filepath.Join(xdgDir("XDG_CACHE_HOME", ".cache"), "emenv")
+}
+
+func NewCache(dir string, max int64) Cache {
+	return Cache{Dir: dir, MaxSize: max}
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// validHash tells whether s is a SHA-256 digest as blobs are named
+// after, which corrupt index files may not hold.
+func validHash(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == sha256.Size*2
+}
+
+func (c *Cache) urlPath(url string) string {
+	return filepath.Join(c.Dir, "urls", hashBytes([]byte(url)))
+}
+
+func (c *Cache) blobPath(hash string) string {
+	return filepath.Join(c.Dir, "blobs", hash)
+}
+
+func (c *Cache) lookup(url string) (string, bool) {
+	index, err := ioutil.ReadFile(c.urlPath(url))
+	if err != nil {
+		return "", false
+	}
+	lines := strings.SplitN(string(index), "\n", 2)
+	return lines[0], validHash(lines[0])
+}
+
+// Get returns the artifact previously fetched from url. Blobs whose
+// contents no longer match their hash are ignored.
+func (c *Cache) Get(url string) ([]byte, bool) {
+	hash, ok := c.lookup(url)
+	if !ok {
+		return nil, false
+	}
+	path := c.blobPath(hash)
+	body, err := ioutil.ReadFile(path)
+	if err != nil || hashBytes(body) != hash {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return body, true
+}
+
+// Put records body as the contents of url. The cache may grow beyond
+// its size limit until it is pruned.
+func (c *Cache) Put(url string, body []byte) error {
+
+	hash := hashBytes(body)
+	for _, dir := range []string{"blobs", "urls"} {
+		if err := os.MkdirAll(filepath.Join(c.Dir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(c.blobPath(hash), body); err != nil {
+		return err
+	}
+	index := fmt.Sprintf("%s\n%s\n", hash, Redact(url))
+	return writeFileAtomic(c.urlPath(url), []byte(index))
+}
+
+func writeFileAtomic(path string, body []byte) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Entries lists cached artifacts, least recently used first.
+func (c *Cache) Entries() ([]CacheEntry, error) {
+
+	entries := make([]CacheEntry, 0)
+	files, err := ioutil.ReadDir(filepath.Join(c.Dir, "urls"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		index, err := ioutil.ReadFile(filepath.Join(c.Dir, "urls", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(string(index), "\n")
+		if len(lines) < 2 || !validHash(lines[0]) {
+			continue
+		}
+		st, err := os.Stat(c.blobPath(lines[0]))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			URL:   lines[1],
+			Hash:  lines[0],
+			Size:  st.Size(),
+			Used:  st.ModTime(),
+			index: f.Name(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Used.Before(entries[j].Used)
+	})
+	return entries, nil
+}
+
+// pruneCache brings the cache back under its size limit at the end of
+// a run, once the artifacts it stored are no longer needed.
+func (env *Env) pruneCache() {
+	if env.Cache.MaxSize <= 0 {
+		return
+	}
+	if _, err := env.Cache.Prune(env.Cache.MaxSize); err != nil {
+		env.notify(Warning{Message: fmt.Sprintf("pruning the cache failed: %s", err)})
+	}
+}
+
+// Prune evicts the least recently used artifacts until the cache
+// holds at most max bytes, returning the evicted entries.
+func (c *Cache) Prune(max int64) ([]CacheEntry, error) {
+
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	// Identical artifacts served from several URLs share a blob,
+	// which must only be accounted for once.
+	total := int64(0)
+	refs := make(map[string]int)
+	for _, e := range entries {
+		if refs[e.Hash] == 0 {
+			total += e.Size
+		}
+		refs[e.Hash]++
+	}
+
+	evicted := make([]CacheEntry, 0)
+	for _, e := range entries {
+		if total <= max {
+			break
+		}
+		// URLs are recorded redacted, the index is found by name
+		if err := os.Remove(filepath.Join(c.Dir, "urls", e.index)); err != nil && !os.IsNotExist(err) {
+			return evicted, err
+		}
+		refs[e.Hash]--
+		if refs[e.Hash] == 0 {
+			if err := os.Remove(c.blobPath(e.Hash)); err != nil && !os.IsNotExist(err) {
+				return evicted, err
+			}
+			total -= e.Size
+		}
+		evicted = append(evicted, e)
+	}
+	return evicted, nil
+}
+
+func (c *Cache) Clear() error {
+	for _, dir := range []string{"blobs", "urls", "git", "partial"} {
+		if err := os.RemoveAll(filepath.Join(c.Dir, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseSize reads a size such as 512M or 2G, suffixes being powers
+// of 1024.
+func ParseSize(s string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	mult := int64(1)
+	literal := s
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if len(s) > 0 {
+		if u, ok := units[s[len(s)-1:]]; ok {
+			mult = u
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %s", literal)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,95 @@
+package emenv
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CompressedSuffixes are tried, in order, after archives or packages
+// which are not found under their plain name.
+var CompressedSuffixes = []string{".gz", ".xz", ".lz", ".bz2"}
+
+// A Compression is recognized by the magic bytes starting the data
+// it produces. Formats the standard library cannot read are handed
+// to Tool.
+type Compression struct {
+	Name  string
+	Magic []byte
+	Tool  string
+}
+
+var compressions = []Compression{
+	{Name: "gzip", Magic: []byte{0x1f, 0x8b}},
+	{Name: "bzip2", Magic: []byte("BZh")},
+	{Name: "xz", Magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, Tool: "xz"},
+	{Name: "lzip", Magic: []byte("LZIP"), Tool: "lzip"},
+	{Name: "zstd", Magic: []byte{0x28, 0xb5, 0x2f, 0xfd}, Tool: "zstd"},
+}
+
+// SniffCompression tells how body is compressed, if at all.
+func SniffCompression(body []byte) (Compression, bool) {
+	for _, c := range compressions {
+		if bytes.HasPrefix(body, c.Magic) {
+			return c, true
+		}
+	}
+	return Compression{}, false
+}
+
+func Decompress(body []byte) ([]byte, error) {
+	return DecompressContext(context.Background(), body)
+}
+
+// DecompressContext returns the contents of body, unpacked when it is
+// compressed in a known format and untouched otherwise. External
+// tools are killed once ctx is done.
+func DecompressContext(ctx context.Context, body []byte) ([]byte, error) {
+
+	c, ok := SniffCompression(body)
+	switch {
+	case !ok:
+		return body, nil
+	case c.Name == "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	case c.Name == "bzip2":
+		return ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(body)))
+	}
+
+	if _, err := exec.LookPath(c.Tool); err != nil {
+		return nil, UnsupportedCompressionError(c.Name, c.Tool)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Tool, "-dc")
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, DecompressionError(c.Name, strings.TrimSpace(stderr.String()), err)
+	}
+	return out, nil
+}
+
+// notFound tells whether a fetch failed because there was nothing at
+// the requested location.
+func notFound(err error) bool {
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.StatusCode == 404 || serr.StatusCode == 410
+	}
+	return os.IsNotExist(errors.Unwrap(err)) || os.IsNotExist(err)
+}
@@ -0,0 +1,70 @@
+package emenv
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const ConfigName = "Emenv"
+
+func xdgDir(variable string, fallback string) string {
+	if dir := os.Getenv(variable); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), fallback)
+}
+
+// ConfigHome is the per-user configuration directory, following the
+// XDG base directory specification.
+func ConfigHome() string {
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "emenv")
+}
+
+// DataHome is where the environment of the per-user configuration
+// lives, following the XDG base directory specification.
+func DataHome() string {
+	return filepath.Join(xdgDir("XDG_DATA_HOME", ".local/share"), "emenv")
+}
+
+// FindConfig looks for an Emenv file in dir and each of its parents,
+// falling back to the one in ConfigHome.
+func FindConfig(dir string) (string, error) {
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, ConfigName)
+		if FileExists(path) {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	path := filepath.Join(ConfigHome(), ConfigName)
+	if FileExists(path) {
+		return path, nil
+	}
+	return "", ConfigNotFoundError(ConfigName)
+}
+
+// DefaultBaseDir is the directory holding the state of the
+// environment described by the configuration at path, when neither
+// options nor the configuration name one: .emenv next to it, or
+// DataHome for the per-user configuration.
+func DefaultBaseDir(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(abs)
+	if dir == ConfigHome() {
+		return DataHome(), nil
+	}
+	return filepath.Join(dir, ".emenv"), nil
+}
@@ -1,31 +1,63 @@
 package emenv
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 )
 
 func (env *Env) Sync() error {
+	return env.SyncContext(context.Background())
+}
+
+// SyncContext fetches the archives of all sources, giving up when ctx
+// is done.
+func (env *Env) SyncContext(ctx context.Context) error {
+
+	lock, err := env.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
 
+	missing := make([]string, 0)
 	for _, src := range(env.Sources) {
-		fmt.Printf("syncing repository %s at %s\n", src.Name, src.URL)
-		if err := env.FetchRepository(src); err != nil {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		if _, local := LocalPath(src.URL); env.Options.Offline && !local {
+			missing = append(missing, fmt.Sprintf("%s/archive-contents", src.URL))
+			continue
+		}
+		env.notify(SyncStarted{Source: src})
+		if err := env.FetchRepositoryContext(ctx, src); err != nil {
+			return err
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &OfflineError{Missing: missing}
 	}
 	return nil
 }
 
 func (env *Env) FetchInstallSet() error {
+	return env.FetchInstallSetContext(context.Background())
+}
+
+// FetchInstallSetContext fetches every package of the install set into
+// the package directory, giving up when ctx is done.
+func (env *Env) FetchInstallSetContext(ctx context.Context) error {
 
 
 	for _, idef := range(env.InstallSet.Packages) {
 		if idef.Type == ProvidedPackage {
 			continue
 		}
-		if err := env.FetchPackage(idef); err != nil {
+		if err := env.FetchPackageContext(ctx, idef); err != nil {
 			return err
 		}
 	}
@@ -33,66 +65,204 @@ func (env *Env) FetchInstallSet() error {
 }
 
 func (env *Env) WritePackageList() error {
-	loadbuf := bytes.NewBufferString(";; autoload-file for Emenv\n")
-	pkgbuf  := bytes.NewBufferString(";; package list file for Emenv\n(\n")
-	for _, idef := range env.InstallSet.Packages {
+	// Paths are computed relative to load.el when it is loaded, so
+	// that the environment keeps working wherever it is moved.
+	loadforms := []Node{
+		NewSymbol("let"),
+		NewList(NewList(
+			NewSymbol("dir"),
+			NewList(NewSymbol("file-name-directory"),
+				NewList(NewSymbol("or"), NewSymbol("load-file-name"), NewSymbol("buffer-file-name"))))),
+	}
+	entries := make([]Node, 0)
+	for _, idef := range env.SortedInstallDefs() {
 		if idef.Type == ProvidedPackage {
-			loadbuf.WriteString(fmt.Sprintf(";; %s is provided\n", idef.Name))
 			continue
 		}
+		dir := NewList(
+			NewSymbol("expand-file-name"),
+			NewString(fmt.Sprintf("packages/%s-%s", idef.Name, idef.Version)),
+			NewSymbol("dir"))
 		if idef.Type == ThemePackage {
-			loadbuf.WriteString(fmt.Sprintf("(add-to-list 'custom-theme-load-path \"%s%s-%s\")\n",
-				env.PackageDir,
-				idef.Name,
-				idef.Version))
-		}
-		loadbuf.WriteString(fmt.Sprintf("(add-to-list 'load-path \"%s%s-%s\")\n",
-			env.PackageDir,
-			idef.Name,
-			idef.Version))
-		pkgbuf.WriteString(fmt.Sprintf("(%s \"%s\" %s)\n", idef.Name, idef.Version, idef.Repo))
-	}
-	pkgbuf.WriteString(")\n")
-	ioutil.WriteFile(fmt.Sprintf("%s/load.el", env.BaseDir), loadbuf.Bytes(), 0644)
-	ioutil.WriteFile(fmt.Sprintf("%s/plist.el", env.BaseDir), pkgbuf.Bytes(), 0644)
-	return nil
+			loadforms = append(loadforms, NewList(
+				NewSymbol("add-to-list"),
+				NewQuote(NewSymbol("custom-theme-load-path")),
+				dir))
+		}
+		loadforms = append(loadforms, NewList(
+			NewSymbol("add-to-list"),
+			NewQuote(NewSymbol("load-path")),
+			dir))
+		entries = append(entries, PackageListEntry(idef))
+	}
+	err := WriteForms(fmt.Sprintf("%s/load.el", env.BaseDir), "autoload-file for Emenv", []Node{NewList(loadforms...)})
+	if err != nil {
+		return err
+	}
+	return WriteForms(fmt.Sprintf("%s/plist.el", env.BaseDir), "package list file for Emenv", []Node{NewList(entries...)})
+}
+
+// PackageListEntry renders the plist.el entry recording an installed
+// package.
+func PackageListEntry(idef InstallDef) Node {
+	entry := NewList(
+		NewSymbol(idef.Name),
+		NewString(idef.Version),
+		NewSymbol(idef.Repo))
+	if len(idef.Path) > 0 {
+		entry.Children = append(entry.Children, NewKeyword("path"), NewString(idef.Path))
+	}
+	if len(idef.Commit) > 0 {
+		entry.Children = append(entry.Children, NewKeyword("commit"), NewString(idef.Commit))
+	}
+	if idef.StoreType == GitStorage {
+		entry.Children = append(entry.Children, NewKeyword("url"), NewString(Redact(idef.URL)))
+		if len(idef.Ref) > 0 {
+			entry.Children = append(entry.Children, NewKeyword("ref"), NewString(idef.Ref))
+		}
+	}
+	return entry
+}
+
+// SortedInstallDefs returns the resolved packages ordered by name,
+// so that generated files are stable across runs.
+func (env *Env) SortedInstallDefs() []InstallDef {
+	names := make([]string, 0)
+	for name, _ := range env.InstallSet.Packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defs := make([]InstallDef, 0)
+	for _, name := range names {
+		defs = append(defs, env.InstallSet.Packages[name])
+	}
+	return defs
 }
 
 func (env *Env) DeletePackage(p InstallDef) error {
-	fmt.Printf("Deleting: %s\n", p.Name)
+	env.notify(PackageDeleted{Def: p})
 	return os.RemoveAll(fmt.Sprintf("%s/%s-%s", env.PackageDir, p.Name, p.Version))
 }
 
 func (env *Env) InstallPackage(p InstallDef) error {
-	return env.FetchPackage(p)
+	return env.InstallPackageContext(context.Background(), p)
+}
+
+// InstallPackageContext fetches a package, giving up when ctx is done.
+func (env *Env) InstallPackageContext(ctx context.Context, p InstallDef) error {
+	return env.FetchPackageContext(ctx, p)
 }
 
 func (env *Env) UpgradePackage(up Upgrade) error {
+	return env.UpgradePackageContext(context.Background(), up)
+}
+
+// UpgradePackageContext replaces a package by its next version, giving
+// up when ctx is done. The next version is staged next to the package
+// directory, and the previous one only removed once it is complete.
+func (env *Env) UpgradePackageContext(ctx context.Context, up Upgrade) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(env.PackageDir, ".upgrade-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := env.fetchPackage(ctx, staging, up.Next); err != nil {
+		return err
+	}
 	if err := env.DeletePackage(up.Prev); err != nil {
 		return err
 	}
-	return env.InstallPackage(up.Next)
+	name := fmt.Sprintf("%s-%s", up.Next.Name, up.Next.Version)
+	dest := filepath.Join(env.PackageDir, name)
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(staging, name), dest)
 }
 
 func (env *Env) ApplyDiffSet() error {
+	return env.ApplyDiffSetContext(context.Background())
+}
+
+// ApplyDiffSetContext deletes, upgrades and installs packages as the
+// diff set says, stopping before the next change once ctx is done.
+func (env *Env) ApplyDiffSetContext(ctx context.Context) error {
 	for _, p := range(env.DiffSet.Delete) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err:= env.DeletePackage(p); err != nil {
 			return err
 		}
 	}
 	for _, u := range(env.DiffSet.Upgrade) {
-		if err := env.UpgradePackage(u); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := env.UpgradePackageContext(ctx, u); err != nil {
 			return err
 		}
 	}
 	for _, p := range(env.DiffSet.Install) {
-		if err := env.InstallPackage(p); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := env.InstallPackageContext(ctx, p); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// CheckOffline ensures that every artifact the install set needs
+// is in the cache, so that nothing gets changed when it could not
+// be completed.
+func (env *Env) CheckOffline(defs []InstallDef) error {
+	if !env.Options.Offline {
+		return nil
+	}
+	missing := make([]string, 0)
+	for _, idef := range defs {
+		if idef.Type == ProvidedPackage {
+			continue
+		}
+		if _, local := LocalPath(idef.URL); local {
+			continue
+		}
+		if idef.StoreType == GitStorage && FileExists(env.GitMirrorDir(idef.URL)) {
+			continue
+		}
+		if _, ok := env.Cache.Get(idef.URL); !ok {
+			missing = append(missing, idef.URL)
+		}
+	}
+	if len(missing) > 0 {
+		return &OfflineError{Missing: missing}
+	}
+	return nil
+}
+
+// PendingDownloads counts the artifacts of defs which are neither
+// local nor cached, and will have to be downloaded.
+func (env *Env) PendingDownloads(defs []InstallDef) int {
+	n := 0
+	for _, idef := range defs {
+		if idef.Type == ProvidedPackage || idef.StoreType == LinkStorage || idef.StoreType == GitStorage {
+			continue
+		}
+		if _, local := LocalPath(idef.URL); local {
+			continue
+		}
+		if _, ok := env.Cache.Get(idef.URL); !ok {
+			n++
+		}
+	}
+	return n
+}
+
 func (env *Env) NoOpDiffSet() bool {
 	return (len(env.DiffSet.Install) == 0 &&
 		len(env.DiffSet.Upgrade) == 0 &&
@@ -101,37 +271,78 @@ func (env *Env) NoOpDiffSet() bool {
 }
 
 func (env *Env) Install() error {
+	return env.InstallContext(context.Background())
+}
+
+// InstallContext brings the package directory in line with the Emenv
+// file, giving up when ctx is done. The package list is only written
+// once every package was installed. The environment stays locked
+// from the moment Options.Bundle is extracted, or archives are read,
+// until the package list is written.
+func (env *Env) InstallContext(ctx context.Context) error {
 
-	err := env.LoadRepositories()
+	lock, err := env.Lock(ctx)
 	if err != nil {
 		return err
 	}
+	defer lock.Release()
+	defer env.pruneCache()
+
+	// The bundle is extracted in the environment, which must be
+	// locked by then
+	if len(env.Options.Bundle) > 0 {
+		if err := env.UseBundle(env.Options.Bundle); err != nil {
+			return err
+		}
+	}
 
-	if err := env.ResolveInstallSet(); err != nil {
+	err = env.LoadRepositoriesContext(ctx)
+	if err != nil {
 		return err
 	}
 
-	DumpNode(env.InstallSet.Tree, 0)
+	env.loadPreviousPackages()
+	env.notify(ResolveStarted{})
+	if err := env.ResolveInstallSetContext(ctx); err != nil {
+		if len(env.Unavailable) > 0 {
+			return &OfflineError{Missing: env.Unavailable, Cause: err}
+		}
+		return err
+	}
+	env.notify(ResolveFinished{Tree: env.InstallSet.Tree})
 
 	if err := env.LoadPreviousInstallSet(); err == nil {
 		if env.NoOpDiffSet() {
-			fmt.Println("nothing to do, bye.")
-			return nil
+			env.notify(NothingToDo{})
+			// The refs of git packages may still have changed
+			return env.WritePackageList()
 		}
-		if !(env.Options.ImplicitYes || Confirm()) {
+		needed := env.DiffSet.Install
+		for _, u := range env.DiffSet.Upgrade {
+			needed = append(needed, u.Next)
+		}
+		if err := env.CheckOffline(needed); err != nil {
+			return err
+		}
+		env.notify(DownloadsPlanned{Count: env.PendingDownloads(needed)})
+		if !env.Confirm() {
 			return nil
 		}
 
-		if err = env.ApplyDiffSet(); err != nil {
+		if err = env.ApplyDiffSetContext(ctx); err != nil {
 			return err
 		}
 	} else {
 
-		if !(env.Options.ImplicitYes || Confirm()) {
+		if err := env.CheckOffline(env.SortedInstallDefs()); err != nil {
+			return err
+		}
+		env.notify(DownloadsPlanned{Count: env.PendingDownloads(env.SortedInstallDefs())})
+		if !env.Confirm() {
 			return nil
 		}
 
-		if err := env.FetchInstallSet(); err != nil {
+		if err := env.FetchInstallSetContext(ctx); err != nil {
 			return err
 		}
 	}
@@ -3,18 +3,43 @@ package emenv
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
+// RepositoryNotFound reports a reference to a repository which no
+// source provides.
+type RepositoryNotFound struct {
+	Name string
+}
+
+func (e *RepositoryNotFound) Error() string {
+	return fmt.Sprintf("Repository not found: %s", e.Name)
+}
+
 func RepositoryNotFoundError(repo string) error {
-	return fmt.Errorf("Repository not found: %s", repo)
+	return &RepositoryNotFound{Name: repo}
+}
+
+// PackageNotFound reports a package missing from repository Repo, or
+// from every repository when Repo is empty.
+type PackageNotFound struct {
+	Name string
+	Repo string
+}
+
+func (e *PackageNotFound) Error() string {
+	if len(e.Repo) == 0 {
+		return fmt.Sprintf("Package %s not found in any repository", e.Name)
+	}
+	return fmt.Sprintf("Package %s not found in %s", e.Name, e.Repo)
 }
 
 func PackageNotFoundError(pkg string, repo string) error {
-	return fmt.Errorf("Package %s not found in %s", pkg, repo)
+	return &PackageNotFound{Name: pkg, Repo: repo}
 }
 
 func NoSuchPackageError(pkg string) error {
-	return fmt.Errorf("Package %s not found in any repository", pkg)
+	return &PackageNotFound{Name: pkg}
 }
 
 var UnreachableError = errors.New("Unreachable code path")
@@ -33,4 +58,245 @@ var DanglingListError = errors.New("Dangling list closing")
 
 var UnknownDirectiveError = errors.New("Unknown directive")
 
+var BadVersionSyntaxError = errors.New("Bad version")
+
 var BadSyntaxError = errors.New("Bad syntax")
+
+var UnexpectedEOFError = errors.New("Unexpected end of input")
+
+// SyntaxError reports malformed input at Pos. Err is, or wraps, one of
+// the syntax errors above, which errors.Is tells apart.
+type SyntaxError struct {
+	Pos Position
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Pos.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+func BadSyntaxAt(pos Position) error {
+	return &SyntaxError{Pos: pos, Err: BadSyntaxError}
+}
+
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (problem Problem) String() string {
+	level := "error"
+	if problem.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", problem.Pos, level, problem.Message)
+}
+
+func (e ValidationError) Error() string {
+	lines := make([]string, 0)
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+	return fmt.Sprintf("Invalid configuration:\n%s", strings.Join(lines, "\n"))
+}
+
+type OptionError struct {
+	Pos       Position
+	Directive string
+	Option    string
+	Reason    string
+}
+
+func (e *OptionError) Error() string {
+	if e.Option == "" {
+		return fmt.Sprintf("%s: %s: %s", e.Pos, e.Directive, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s option %s: %s", e.Pos, e.Directive, e.Option, e.Reason)
+}
+
+type ConfigNotFound struct {
+	Name string
+}
+
+func (e *ConfigNotFound) Error() string {
+	return fmt.Sprintf("No %s file found in this directory or its parents", e.Name)
+}
+
+func ConfigNotFoundError(name string) error {
+	return &ConfigNotFound{Name: name}
+}
+
+// OfflineError lists the artifacts which would have to be fetched
+// from the network for an operation to succeed in offline mode.
+type OfflineError struct {
+	Missing []string
+	Cause   error
+}
+
+func (e *OfflineError) Error() string {
+	msg := "Offline mode, unavailable artifacts:"
+	if e.Cause != nil {
+		msg = fmt.Sprintf("%s (offline mode, unavailable artifacts:", e.Cause)
+	}
+	for _, m := range e.Missing {
+		msg = fmt.Sprintf("%s\n  %s", msg, Redact(m))
+	}
+	if e.Cause != nil {
+		msg = msg + ")"
+	}
+	return msg
+}
+
+func (e *OfflineError) Unwrap() error {
+	return e.Cause
+}
+
+// BadVersionError reports a version which is not made of numbers,
+// with no position until BadVersionAt is used by a caller who knows it.
+func BadVersionError(version string) error {
+	return BadVersionAt(Position{}, version)
+}
+
+func BadVersionAt(pos Position, version string) error {
+	return &SyntaxError{Pos: pos, Err: fmt.Errorf("%w: %s", BadVersionSyntaxError, version)}
+}
+
+// GitCommandError reports a git command which failed, with what it
+// printed on its standard error.
+type GitCommandError struct {
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+func (e *GitCommandError) Error() string {
+	redacted := make([]string, 0)
+	for _, arg := range e.Args {
+		redacted = append(redacted, Redact(arg))
+	}
+	return fmt.Sprintf("git %s failed: %s: %s", strings.Join(redacted, " "), e.Err, e.Stderr)
+}
+
+func (e *GitCommandError) Unwrap() error {
+	return e.Err
+}
+
+func GitError(args []string, stderr string, err error) error {
+	return &GitCommandError{Args: args, Stderr: stderr, Err: err}
+}
+
+func FileNotInRecipeError(file string) error {
+	return fmt.Errorf("File not selected by recipe: %s", file)
+}
+
+func BadBundleError(path string, err error) error {
+	return fmt.Errorf("Bad bundle %s: %w", path, err)
+}
+
+type MissingCredentials struct {
+	Reason string
+}
+
+func (e *MissingCredentials) Error() string {
+	return fmt.Sprintf("Missing credentials: %s", e.Reason)
+}
+
+func MissingCredentialsError(reason string) error {
+	return &MissingCredentials{Reason: reason}
+}
+
+func BadCABundleError(path string) error {
+	return fmt.Errorf("No certificate found in CA bundle %s", path)
+}
+
+// FetchError reports a file which no URL of a source could serve,
+// with the failure met at each of them.
+type FetchError struct {
+	Source   string
+	File     string
+	Failures []error
+}
+
+func (e *FetchError) Error() string {
+	msg := fmt.Sprintf("Could not fetch %s from any URL of source %s:", e.File, e.Source)
+	for _, err := range e.Failures {
+		msg = fmt.Sprintf("%s\n  %s", msg, err)
+	}
+	return msg
+}
+
+func (e *FetchError) Unwrap() []error {
+	return e.Failures
+}
+
+func MirrorsFailedError(source string, file string, failures []error) error {
+	return &FetchError{Source: source, File: file, Failures: failures}
+}
+
+func UnsupportedCompressionError(format string, tool string) error {
+	return fmt.Errorf("Cannot read %s compressed data: %s is not installed", format, tool)
+}
+
+func DecompressionError(format string, stderr string, err error) error {
+	return fmt.Errorf("Decompressing %s data failed: %w: %s", format, err, stderr)
+}
+
+func UnsupportedURLError(url string) error {
+	return fmt.Errorf("No fetcher for %s", url)
+}
+
+// IncludeCycleError reports the include directive at pos, which pulls
+// in a file being read already.
+func IncludeCycleError(pos Position, chain []string) error {
+	return &OptionError{Pos: pos, Directive: "include",
+		Reason: fmt.Sprintf("cycle %s", strings.Join(chain, " -> "))}
+}
+
+// Locked reports an environment which another process is changing.
+type Locked struct {
+	Path   string
+	Holder LockHolder
+}
+
+func (e *Locked) Error() string {
+	if e.Holder.PID == 0 {
+		return fmt.Sprintf("Environment locked by another process: %s", e.Path)
+	}
+	return fmt.Sprintf("Environment locked by process %d since %s: %s",
+		e.Holder.PID, e.Holder.Started.Format("15:04:05"), e.Path)
+}
+
+// ResolutionConflict reports a package of which no available version
+// satisfies everything required of it.
+type ResolutionConflict struct {
+	Name         string
+	Requirements []Requirement
+	Available    []string
+}
+
+func (e *ResolutionConflict) Error() string {
+	msg := fmt.Sprintf("No version of %s satisfies all requirements:", e.Name)
+	for _, r := range e.Requirements {
+		msg = fmt.Sprintf("%s\n  %s", msg, r)
+	}
+	if len(e.Available) == 0 {
+		return msg + "\n  none available"
+	}
+	return fmt.Sprintf("%s\n  available: %s", msg, strings.Join(e.Available, "; "))
+}
+
+// ResolutionAborted reports a search for versions given up after too
+// many steps, which tells nothing of whether a solution exists.
+type ResolutionAborted struct {
+	Steps int
+}
+
+func (e *ResolutionAborted) Error() string {
+	return fmt.Sprintf("Resolution aborted after %d steps", e.Steps)
+}
@@ -0,0 +1,305 @@
+package emenv
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An Event reports what emenv is doing. Embedders receive events
+// through an Observer and may switch on their concrete types; String
+// renders them the way the command line shows them, events with
+// nothing to show rendering as the empty string.
+type Event interface {
+	String() string
+}
+
+type Observer interface {
+	Notify(ev Event)
+}
+
+// ObserverFunc lets a plain function observe events.
+type ObserverFunc func(ev Event)
+
+func (f ObserverFunc) Notify(ev Event) {
+	f(ev)
+}
+
+func (env *Env) notify(ev Event) {
+	if env.Observer != nil {
+		env.Observer.Notify(ev)
+	}
+}
+
+// Origin tells where a package artifact is read from.
+type Origin int
+
+const (
+	OriginLocal Origin = iota
+	// Artifacts of sources are read through the fetcher, from the
+	// cache or the network
+	OriginSource
+)
+
+type ResolveStarted struct{}
+
+type ResolveFinished struct {
+	Tree InstallNode
+}
+
+type DiffComputed struct {
+	Diff DiffSet
+}
+
+type NothingToDo struct{}
+
+type SyncStarted struct {
+	Source Source
+}
+
+type RepositoryFetching struct {
+	Source Source
+}
+
+type RepositoryUnavailable struct {
+	Source Source
+}
+
+type RepositoryLoaded struct {
+	Source Source
+	Path   string
+}
+
+type MirrorUsed struct {
+	URL string
+}
+
+type FetchFailed struct {
+	URL string
+	Err error
+}
+
+type RequestRetried struct {
+	URL  string
+	Wait time.Duration
+	Err  error
+}
+
+type PackageFetching struct {
+	Def    InstallDef
+	Origin Origin
+}
+
+type ArtifactCached struct {
+	URL string
+}
+
+type PackageFetched struct {
+	Def InstallDef
+}
+
+type PackageLinked struct {
+	Def InstallDef
+}
+
+type PackageDeleted struct {
+	Def InstallDef
+}
+
+type GitActivity struct {
+	Op     string
+	URL    string
+	Commit string
+}
+
+type RecipeBuilding struct {
+	Name    string
+	Version string
+	URL     string
+}
+
+type Warning struct {
+	Message string
+}
+
+type DownloadsPlanned struct {
+	Count int
+}
+
+type DownloadStarted struct {
+	URL    string
+	Offset int64
+	Size   int64
+}
+
+type DownloadProgressed struct {
+	URL   string
+	Bytes int64
+}
+
+type DownloadFinished struct {
+	URL string
+	Err error
+}
+
+type LockWaiting struct {
+	Path   string
+	Holder LockHolder
+}
+
+type BundleAdded struct {
+	File string
+}
+
+type BundleWritten struct {
+	Path     string
+	Packages int
+}
+
+type BundleExtracting struct {
+	Path string
+}
+
+type ServeStarted struct {
+	Addr    string
+	Sources int
+}
+
+type RequestServed struct {
+	Path  string
+	Found bool
+}
+
+func (ResolveStarted) String() string {
+	return ""
+}
+
+func (e ResolveFinished) String() string {
+	buf := new(bytes.Buffer)
+	DumpNode(buf, e.Tree, 0)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (e DiffComputed) String() string {
+	buf := new(bytes.Buffer)
+	DumpDiffSet(buf, e.Diff)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (NothingToDo) String() string {
+	return "nothing to do, bye."
+}
+
+func (e SyncStarted) String() string {
+	return fmt.Sprintf("syncing repository %s at %s", e.Source.Name, Redact(e.Source.URL))
+}
+
+func (e RepositoryFetching) String() string {
+	return fmt.Sprintf("fetching repository %s from %s", e.Source.Name, Redact(e.Source.URL))
+}
+
+func (e RepositoryUnavailable) String() string {
+	return fmt.Sprintf("repository %s unavailable offline", e.Source.Name)
+}
+
+func (e RepositoryLoaded) String() string {
+	return fmt.Sprintf("loaded repository %s from %s", e.Source.Name, e.Path)
+}
+
+func (e MirrorUsed) String() string {
+	return fmt.Sprintf("served by mirror: %s", Redact(e.URL))
+}
+
+func (e FetchFailed) String() string {
+	return fmt.Sprintf("could not fetch %s: %s", Redact(e.URL), e.Err)
+}
+
+func (e RequestRetried) String() string {
+	return fmt.Sprintf("retrying %s in %s: %s", Redact(e.URL), e.Wait, e.Err)
+}
+
+func (e PackageFetching) String() string {
+	switch e.Origin {
+	case OriginLocal:
+		return fmt.Sprintf("reading from: %s", Redact(e.Def.URL))
+	}
+	return fmt.Sprintf("fetching: %s", Redact(e.Def.URL))
+}
+
+func (e ArtifactCached) String() string {
+	return fmt.Sprintf("cached: %s", Redact(e.URL))
+}
+
+func (PackageFetched) String() string {
+	return ""
+}
+
+func (e PackageLinked) String() string {
+	return fmt.Sprintf("linking: %s", e.Def.Path)
+}
+
+func (e PackageDeleted) String() string {
+	return fmt.Sprintf("Deleting: %s", e.Def.Name)
+}
+
+func (e GitActivity) String() string {
+	if len(e.Commit) > 0 {
+		return fmt.Sprintf("%s %s at %s", e.Op, Redact(e.URL), e.Commit)
+	}
+	return fmt.Sprintf("%s git repository %s", e.Op, Redact(e.URL))
+}
+
+func (e RecipeBuilding) String() string {
+	return fmt.Sprintf("building %s %s from %s", e.Name, e.Version, Redact(e.URL))
+}
+
+func (e Warning) String() string {
+	return e.Message
+}
+
+func (e DownloadsPlanned) String() string {
+	return ""
+}
+
+func (e DownloadStarted) String() string {
+	return fmt.Sprintf("downloading %s", Redact(e.URL))
+}
+
+func (e DownloadProgressed) String() string {
+	return ""
+}
+
+func (e DownloadFinished) String() string {
+	return ""
+}
+
+func (e LockWaiting) String() string {
+	if e.Holder.PID == 0 {
+		return fmt.Sprintf("waiting for another process to release %s", e.Path)
+	}
+	return fmt.Sprintf("waiting for process %d to release %s", e.Holder.PID, e.Path)
+}
+
+func (e BundleAdded) String() string {
+	return fmt.Sprintf("bundling %s", e.File)
+}
+
+func (e BundleWritten) String() string {
+	return fmt.Sprintf("wrote %d packages to %s", e.Packages, e.Path)
+}
+
+func (e BundleExtracting) String() string {
+	return fmt.Sprintf("extracting bundle %s", e.Path)
+}
+
+func (e ServeStarted) String() string {
+	return fmt.Sprintf("serving %d sources on %s", e.Sources, e.Addr)
+}
+
+func (e RequestServed) String() string {
+	if !e.Found {
+		return fmt.Sprintf("not available: %s", e.Path)
+	}
+	return fmt.Sprintf("serving %s", e.Path)
+}
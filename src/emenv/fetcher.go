@@ -2,17 +2,42 @@ package emenv
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 )
 
+// LocalPath returns the filesystem path designated by a file:// URL
+// or a plain path, and false for network URLs.
+func LocalPath(rawurl string) (string, bool) {
+	if strings.HasPrefix(rawurl, "file://") {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", false
+		}
+		return u.Path, true
+	}
+	if strings.Contains(rawurl, "://") {
+		return "", false
+	}
+	return rawurl, true
+}
+
+
 func (env *Env) FetchFilePackage(p InstallDef, body []byte) error {
+	return env.extractFile(env.PackageDir, p, body)
+}
 
-	dir := fmt.Sprintf("%s/%s-%s", env.PackageDir, p.Name, p.Version)
+// extractFile writes a single file package under root.
+func (env *Env) extractFile(root string, p InstallDef, body []byte) error {
+
+	dir := fmt.Sprintf("%s/%s-%s", root, p.Name, p.Version)
 	file := fmt.Sprintf("%s/%s.el", dir, p.Name)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -33,22 +58,27 @@ func ReadTarEntry(hdr *tar.Header, rdr *tar.Reader) ([]byte, error) {
 
 		b := make([]byte, remaining)
 		br, err := rdr.Read(b)
+		// The last chunk may come along with io.EOF
+		outbuf = append(outbuf, b[0:br]...)
 		if err == io.EOF {
 			return outbuf, nil
 		}
 		if err != nil {
 			return outbuf, err
 		}
-		b = b[0:br]
-		outbuf = append(outbuf, b...)
 		remaining = remaining - int64(br)
 	}
 	return outbuf, UnreachableError
 }
 
 func (env *Env) FetchTarPackage(p InstallDef, rdr *tar.Reader) error {
+	return env.extractTar(env.PackageDir, p, rdr)
+}
 
-	dir := fmt.Sprintf("%s/%s-%s", env.PackageDir, p.Name, p.Version)
+// extractTar writes the entries of a tar package under root.
+func (env *Env) extractTar(root string, p InstallDef, rdr *tar.Reader) error {
+
+	dir := fmt.Sprintf("%s/%s-%s", root, p.Name, p.Version)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
@@ -69,7 +99,7 @@ func (env *Env) FetchTarPackage(p InstallDef, rdr *tar.Reader) error {
 			if err != nil {
 				return err
 			}
-			fpath := fmt.Sprintf("%s/%s", env.PackageDir, hdr.Name)
+			fpath := fmt.Sprintf("%s/%s", root, hdr.Name)
 			dir := path.Dir(fpath)
 			if err = os.MkdirAll(dir, 0755); err != nil {
 				return err
@@ -79,39 +109,99 @@ func (env *Env) FetchTarPackage(p InstallDef, rdr *tar.Reader) error {
 			}
 			break
 		case (hdr.Typeflag == tar.TypeDir):
-			path := fmt.Sprintf("%s/%s", env.PackageDir, hdr.Name)
+			path := fmt.Sprintf("%s/%s", root, hdr.Name)
 			if err = os.MkdirAll(path, 0755); err != nil {
 				return err
 			}
 			break
+		case (hdr.Typeflag == tar.TypeXGlobalHeader):
+			break
 		default:
-			fmt.Printf("unhandled entry type: %c\n", hdr.Typeflag)
+			env.notify(Warning{Message: fmt.Sprintf("unhandled entry type: %c", hdr.Typeflag)})
 		}
 	}
 }
 
+func (env *Env) DownloadPackage(idef InstallDef) ([]byte, error) {
+	return env.DownloadPackageContext(context.Background(), idef)
+}
+
+// DownloadPackageContext returns the artifact of a package through
+// the fetcher of the environment, which the default one serves from
+// the shared cache when it was fetched before by any environment. It
+// gives up when ctx is done.
+func (env *Env) DownloadPackageContext(ctx context.Context, idef InstallDef) ([]byte, error) {
+
+	if _, ok := LocalPath(idef.URL); ok {
+		env.notify(PackageFetching{Def: idef, Origin: OriginLocal})
+		body, _, err := env.FetchArtifactContext(ctx, idef)
+		return body, err
+	}
+
+	env.notify(PackageFetching{Def: idef, Origin: OriginSource})
+	body, url, err := env.FetchArtifactContext(ctx, idef)
+	if err != nil {
+		return nil, err
+	}
+	if src, ok := env.Sources[idef.Repo]; ok && !strings.HasPrefix(url, src.URL+"/") {
+		env.notify(MirrorUsed{URL: url})
+	}
+	return body, nil
+}
+
 func (env *Env) FetchPackage(idef InstallDef) error {
+	return env.FetchPackageContext(context.Background(), idef)
+}
+
+// FetchPackageContext installs a package in the package directory,
+// giving up when ctx is done. Whatever was written of a package which
+// failed to install is removed.
+func (env *Env) FetchPackageContext(ctx context.Context, idef InstallDef) error {
+	return env.fetchPackage(ctx, env.PackageDir, idef)
+}
+
+// fetchPackage installs a package under root, which is the package
+// directory unless the package is staged.
+func (env *Env) fetchPackage(ctx context.Context, root string, idef InstallDef) error {
+
+	var err error
+	switch {
+	case idef.StoreType == LinkStorage:
+		err = env.linkPackage(root, idef)
+	case idef.StoreType == GitStorage:
+		err = env.fetchGitPackage(ctx, root, idef)
+	default:
+		err = env.unpackPackage(ctx, root, idef)
+	}
+	if err != nil {
+		os.RemoveAll(fmt.Sprintf("%s/%s-%s", root, idef.Name, idef.Version))
+		return fmt.Errorf("Installing %s %s: %w", idef.Name, idef.Version, err)
+	}
+	env.notify(PackageFetched{Def: idef})
+	return nil
+}
+
+// unpackPackage installs a package distributed as a single file or a
+// tarball.
+func (env *Env) unpackPackage(ctx context.Context, root string, idef InstallDef) error {
 
-	fmt.Printf("fetching from: %s\n", idef.URL)
-	resp, err := http.Get(idef.URL)
+	body, err := env.DownloadPackageContext(ctx, idef)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	if body, err = DecompressContext(ctx, body); err != nil {
+		return err
+	}
 
 	switch {
 	case idef.StoreType == FileStorage:
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
-		err = env.FetchFilePackage(idef, body)
+		err = env.extractFile(root, idef, body)
 		if err != nil {
 			return err
 		}
 	case idef.StoreType == TarStorage:
-		rdr := tar.NewReader(resp.Body)
-		err = env.FetchTarPackage(idef, rdr)
+		rdr := tar.NewReader(bytes.NewReader(body))
+		err = env.extractTar(root, idef, rdr)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,150 @@
+package emenv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A Fetcher retrieves the resources of sources: their archive index
+// and the package artifacts it lists. The source tells how to reach
+// url, which may be the URL of one of its mirrors; AuthFor tells
+// whether its credentials may be sent there. Fetchers report missing
+// resources with errors for which os.IsNotExist holds, or with a 404
+// StatusError, and give up when ctx is done.
+type Fetcher interface {
+	FetchArchive(ctx context.Context, src Source, url string) ([]byte, error)
+	FetchArtifact(ctx context.Context, src Source, url string) ([]byte, error)
+}
+
+// DefaultFetcher reads local sources from the filesystem and others
+// over HTTP with client, keeping artifacts in cache.
+func DefaultFetcher(client *Client, cache *Cache) Fetcher {
+	return &FileFetcher{Next: &CacheFetcher{Cache: cache, Next: &HTTPFetcher{Client: client},
+		Observer: client.Observer}}
+}
+
+// HTTPFetcher fetches resources with a Client, authenticating as the
+// source requires.
+type HTTPFetcher struct {
+	Client *Client
+}
+
+func (f *HTTPFetcher) FetchArchive(ctx context.Context, src Source, url string) ([]byte, error) {
+	return f.Client.GetContext(ctx, url, src.Timeout, src.AuthFor(url))
+}
+
+func (f *HTTPFetcher) FetchArtifact(ctx context.Context, src Source, url string) ([]byte, error) {
+	return f.Client.GetContext(ctx, url, src.Timeout, src.AuthFor(url))
+}
+
+// FileFetcher reads file:// URLs and plain paths, handing other URLs
+// to Next when there is one.
+type FileFetcher struct {
+	Next Fetcher
+}
+
+func (f *FileFetcher) read(ctx context.Context, url string, next func() ([]byte, error)) ([]byte, error) {
+	if path, ok := LocalPath(url); ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(path)
+	}
+	if f.Next == nil {
+		return nil, UnsupportedURLError(url)
+	}
+	return next()
+}
+
+func (f *FileFetcher) FetchArchive(ctx context.Context, src Source, url string) ([]byte, error) {
+	return f.read(ctx, url, func() ([]byte, error) { return f.Next.FetchArchive(ctx, src, url) })
+}
+
+func (f *FileFetcher) FetchArtifact(ctx context.Context, src Source, url string) ([]byte, error) {
+	return f.read(ctx, url, func() ([]byte, error) { return f.Next.FetchArtifact(ctx, src, url) })
+}
+
+// CacheFetcher serves artifacts from a Cache. Those it does not hold
+// are fetched from Next and stored, or reported missing when Next is
+// nil. Archives always come from Next, being expected to change.
+// Artifacts are cached under the URL of the source whichever mirror
+// served them, and hits are reported to Observer.
+type CacheFetcher struct {
+	Cache    *Cache
+	Next     Fetcher
+	Observer Observer
+}
+
+// cacheKey names url after the primary URL of src when it points into
+// one of its mirrors.
+func cacheKey(src Source, url string) string {
+	for _, mirror := range src.Mirrors {
+		if strings.HasPrefix(url, mirror+"/") {
+			return src.URL + strings.TrimPrefix(url, mirror)
+		}
+	}
+	return url
+}
+
+func (f *CacheFetcher) FetchArchive(ctx context.Context, src Source, url string) ([]byte, error) {
+	if f.Next == nil {
+		return nil, &os.PathError{Op: "fetch", Path: url, Err: os.ErrNotExist}
+	}
+	return f.Next.FetchArchive(ctx, src, url)
+}
+
+func (f *CacheFetcher) FetchArtifact(ctx context.Context, src Source, url string) ([]byte, error) {
+	key := cacheKey(src, url)
+	if body, ok := f.Cache.Get(key); ok {
+		if f.Observer != nil {
+			f.Observer.Notify(ArtifactCached{URL: key})
+		}
+		return body, nil
+	}
+	if f.Next == nil {
+		return nil, &os.PathError{Op: "fetch", Path: url, Err: os.ErrNotExist}
+	}
+	body, err := f.Next.FetchArtifact(ctx, src, url)
+	if err != nil {
+		return nil, err
+	}
+	// The artifact was fetched, not caching it only costs a download
+	if err := f.Cache.Put(key, body); err != nil && f.Observer != nil {
+		f.Observer.Notify(Warning{Message: fmt.Sprintf("could not cache %s: %s", Redact(key), err)})
+	}
+	return body, nil
+}
+
+// MemoryFetcher serves resources held in memory, keyed by URL. It
+// lets emenv run against fake sources, without any I/O.
+type MemoryFetcher struct {
+	Files   map[string][]byte
+	Fetched []string
+}
+
+func NewMemoryFetcher() *MemoryFetcher {
+	return &MemoryFetcher{Files: make(map[string][]byte), Fetched: make([]string, 0)}
+}
+
+func (f *MemoryFetcher) fetch(ctx context.Context, url string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.Fetched = append(f.Fetched, url)
+	body, ok := f.Files[url]
+	if !ok {
+		return nil, &os.PathError{Op: "fetch", Path: url, Err: os.ErrNotExist}
+	}
+	return body, nil
+}
+
+func (f *MemoryFetcher) FetchArchive(ctx context.Context, src Source, url string) ([]byte, error) {
+	return f.fetch(ctx, url)
+}
+
+func (f *MemoryFetcher) FetchArtifact(ctx context.Context, src Source, url string) ([]byte, error) {
+	return f.fetch(ctx, url)
+}
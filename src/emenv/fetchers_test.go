@@ -0,0 +1,208 @@
+package emenv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type acceptAll struct{}
+
+func (acceptAll) Confirm(question string) bool { return true }
+
+// memoryEnv loads the Emenv file config from a new directory, with
+// every source served by a MemoryFetcher. Sources other than fake
+// have a placeholder archive.
+func memoryEnv(t *testing.T, dir string, config string) (*Env, *MemoryFetcher) {
+	t.Helper()
+	path := filepath.Join(dir, ConfigName)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env, err := LoadEnv(path, Options{CacheDir: filepath.Join(dir, "cache"), Prompter: acceptAll{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := NewMemoryFetcher()
+	for _, src := range env.Sources {
+		mem.Files[src.URL+"/archive-contents"] = []byte(`(1 (other . [(1) nil "x" single]))`)
+	}
+	env.Fetcher = mem
+	return env, mem
+}
+
+// TestInstallFromMemory installs from fake sources served by a
+// MemoryFetcher, without touching the network.
+func TestInstallFromMemory(t *testing.T) {
+
+	env, mem := memoryEnv(t, t.TempDir(), `(source fake "https://fake.example/elpa")
+(prefer fake)
+(package ag)
+`)
+	mem.Files["https://fake.example/elpa/archive-contents"] = []byte(`(1
+ (dash . [(2 0) nil "lists" single])
+ (ag . [(0 48) ((dash (2 0))) "search" single]))`)
+	mem.Files["https://fake.example/elpa/dash-2.0.el"] = []byte(";;; dash.el\n")
+	mem.Files["https://fake.example/elpa/ag-0.48.el"] = []byte(";;; ag.el\n")
+
+	if err := env.Install(); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{
+		"dash-2.0/dash.el": ";;; dash.el\n",
+		"ag-0.48/ag.el":    ";;; ag.el\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(env.PackageDir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s holds %q, want %q", file, got, want)
+		}
+	}
+	entries, err := ioutil.ReadDir(env.PackageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%d packages installed, want 2", len(entries))
+	}
+
+	plist, err := ReadPackageList(filepath.Join(env.BaseDir, "plist.el"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plist) != 2 ||
+		plist["ag"].Version != "0.48" || plist["ag"].Repo != "fake" ||
+		plist["dash"].Version != "2.0" || plist["dash"].Repo != "fake" {
+		t.Errorf("unexpected package list %v", plist)
+	}
+	if _, err := os.Stat(filepath.Join(env.BaseDir, "load.el")); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestUpgradeKeepsPrevious checks that a package is only replaced once
+// its next version is installed.
+func TestUpgradeKeepsPrevious(t *testing.T) {
+
+	dir := t.TempDir()
+	config := `(source fake "https://fake.example/elpa")
+(prefer fake)
+(package dash)
+`
+	env, mem := memoryEnv(t, dir, config)
+	mem.Files["https://fake.example/elpa/archive-contents"] = []byte(`(1 (dash . [(1 0) nil "lists" single]))`)
+	mem.Files["https://fake.example/elpa/dash-1.0.el"] = []byte(";;; dash 1\n")
+	if err := env.Install(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next version cannot be fetched
+	env, mem = memoryEnv(t, dir, config)
+	mem.Files["https://fake.example/elpa/archive-contents"] = []byte(`(1 (dash . [(2 0) nil "lists" single]))`)
+	if err := env.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Install(); err == nil {
+		t.Fatal("upgrade to a missing artifact succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(env.PackageDir, "dash-1.0", "dash.el")); err != nil {
+		t.Fatalf("previous version removed by a failed upgrade: %s", err)
+	}
+
+	mem.Files["https://fake.example/elpa/dash-2.0.el"] = []byte(";;; dash 2\n")
+	if err := env.Install(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(env.PackageDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "dash-2.0" {
+		t.Errorf("package directory holds %v, want dash-2.0 only", entries)
+	}
+}
+
+func TestCacheFetcher(t *testing.T) {
+
+	cache := NewCache(t.TempDir(), DefaultCacheSize)
+	mem := NewMemoryFetcher()
+	mem.Files["https://mirror.example/elpa/dash-2.0.el"] = []byte(";;; dash.el\n")
+	f := &CacheFetcher{Cache: &cache, Next: mem}
+	src := Source{Name: "fake", URL: "https://fake.example/elpa", Mirrors: []string{"https://mirror.example/elpa"}}
+	ctx := context.Background()
+
+	// Served by the mirror, cached under the URL of the source
+	if _, err := f.FetchArtifact(ctx, src, "https://mirror.example/elpa/dash-2.0.el"); err != nil {
+		t.Fatal(err)
+	}
+	body, err := f.FetchArtifact(ctx, src, "https://fake.example/elpa/dash-2.0.el")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != ";;; dash.el\n" {
+		t.Errorf("cached artifact holds %q", body)
+	}
+	if len(mem.Fetched) != 1 {
+		t.Errorf("fetched %v, want only the first request", mem.Fetched)
+	}
+
+	// Without Next, only cached artifacts are found
+	f.Next = nil
+	if _, err := f.FetchArtifact(ctx, src, "https://fake.example/elpa/s-1.0.el"); !os.IsNotExist(err) {
+		t.Errorf("missing artifact reported as %v", err)
+	}
+}
+
+// TestQuotedDirectiveArguments loads an Emenv file quoting symbols as
+// emacs-lisp would.
+func TestQuotedDirectiveArguments(t *testing.T) {
+
+	env, _ := memoryEnv(t, t.TempDir(), `(source 'fake "https://fake.example/elpa")
+(prefer 'fake 'gnu)
+(package 'ag (from 'fake))
+(provided 'dash)
+`)
+	if len(env.Prefer) < 2 || env.Prefer[0] != "fake" || env.Prefer[1] != "gnu" {
+		t.Errorf("prefer read as %v", env.Prefer)
+	}
+	if _, ok := env.Sources["fake"]; !ok {
+		t.Errorf("source fake not declared")
+	}
+	if len(env.Packages) != 1 || env.Packages[0].Name != "ag" || env.Packages[0].Repo != "fake" {
+		t.Errorf("packages read as %+v", env.Packages)
+	}
+	if len(env.Provided) != 1 || env.Provided[0] != "dash" {
+		t.Errorf("provided read as %v", env.Provided)
+	}
+}
+
+// TestCachePrunedAfterInstall installs a recipe, whose package is only
+// kept in the cache, with a cache too small to hold it: the cache is
+// pruned once the install is over, not before it read the package.
+func TestCachePrunedAfterInstall(t *testing.T) {
+
+	checkout := pinnedCheckout(t)
+	env, mem := memoryEnv(t, t.TempDir(), fmt.Sprintf("(recipe b :fetcher git :url %q)\n", checkout))
+	env.Cache.MaxSize = 1
+	env.Fetcher = &CacheFetcher{Cache: &env.Cache, Next: mem}
+
+	if err := env.Install(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(env.PackageDir, "b-"+SnapshotVersion(pinnedTime).Literal, "b.el")); err != nil {
+		t.Error(err)
+	}
+	entries, err := env.Cache.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("cache still holds %v", entries)
+	}
+}
@@ -0,0 +1,343 @@
+package emenv
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+type configForm struct {
+	Node     Node
+	Comments []string
+	Trailing string
+	Group    int
+	// Text is the source of a form holding comments, which is kept
+	// as written rather than printed from Node
+	Text string
+	// Body and Footer hold the directives of a profile block holding
+	// comments, with the comments following the last one, and Opening
+	// the comment following its name
+	Body    []configForm
+	Footer  []string
+	Opening string
+}
+
+// directiveRank orders top-level directives in canonical output:
+// repository setup comes first, package lists come last.
+func directiveRank(node Node) int {
+	if len(node.Children) == 0 || node.Children[0].Type != SymbolNode {
+		return 3
+	}
+	switch node.Children[0].String {
+	case "include":
+		return -1
+	case "source":
+		return 0
+	case "prefer":
+		return 1
+	case "provided":
+		return 2
+	case "package":
+		return 4
+	case "theme":
+		return 5
+	case "profile":
+		return 6
+	}
+	return 3
+}
+
+func isPackageForm(node Node) bool {
+	rank := directiveRank(node)
+	return (rank == 4 || rank == 5) && len(node.Children) > 1
+}
+
+// sourceText returns the text of lines from the token at from to the
+// single character token at to.
+func sourceText(lines [][]rune, from, to Position) string {
+	if from.Line == to.Line {
+		return string(lines[from.Line-1][from.Column-1 : to.Column])
+	}
+	text := []string{string(lines[from.Line-1][from.Column-1:])}
+	for line := from.Line + 1; line < to.Line; line++ {
+		text = append(text, string(lines[line-1]))
+	}
+	text = append(text, string(lines[to.Line-1][:to.Column]))
+	return strings.Join(text, "\n")
+}
+
+// commentedForm lets the comments of form stay where they are. The
+// directives of a profile block are formatted on their own, any other
+// form is kept as written.
+func commentedForm(form configForm, tokens []Token, lines [][]rune) configForm {
+	if directiveRank(form.Node) == 6 && len(form.Node.Children) > 2 {
+		// Skip the parenthesis, the directive and the profile name
+		start, code := 0, 0
+		for code < 3 {
+			if tokens[start].Type != CommentToken {
+				code++
+			}
+			start++
+		}
+		if t := tokens[start]; t.Type == CommentToken && t.Pos.Line == tokens[start-1].Pos.Line {
+			form.Opening = t.String
+			start++
+		}
+		header, body, footer, err := splitConfigForms(tokens[start:len(tokens)-1], lines)
+		if err == nil {
+			if len(body) > 0 {
+				body[0].Comments = append(header, body[0].Comments...)
+			} else {
+				footer = append(header, footer...)
+			}
+			form.Body = body
+			form.Footer = footer
+			return form
+		}
+	}
+	form.Text = sourceText(lines, tokens[0].Pos, tokens[len(tokens)-1].Pos)
+	return form
+}
+
+func splitConfigForms(tokens []Token, lines [][]rune) ([]string, []configForm, []string, error) {
+	header := make([]string, 0)
+	forms := make([]configForm, 0)
+	pending := make([]string, 0)
+	current := make([]Token, 0)
+	commented := false
+	depth := 0
+	lastLine := 0
+	commentLine := 0
+
+	for _, token := range tokens {
+		switch {
+		case token.Type == CommentToken && depth > 0:
+			current = append(current, token)
+			commented = true
+			continue
+		case token.Type == CommentToken:
+			last := len(forms) - 1
+			if last >= 0 && token.Pos.Line == lastLine && forms[last].Trailing == "" {
+				forms[last].Trailing = token.String
+				continue
+			}
+			if len(forms) == 0 && len(pending) > 0 && token.Pos.Line > commentLine+1 {
+				header = append(header, pending...)
+				pending = make([]string, 0)
+			}
+			pending = append(pending, token.String)
+			commentLine = token.Pos.Line
+			continue
+		case token.Type == OpenParToken || token.Type == OpenVectorToken:
+			depth++
+		case token.Type == CloseParToken || token.Type == CloseVectorToken:
+			depth--
+		}
+
+		if len(current) == 0 && len(forms) == 0 && len(pending) > 0 &&
+			token.Pos.Line > commentLine+1 {
+			header = append(header, pending...)
+			pending = make([]string, 0)
+		}
+		current = append(current, token)
+		if depth > 0 || token.Type == QuoteToken {
+			continue
+		}
+
+		code := make([]Token, 0, len(current))
+		for _, t := range current {
+			if t.Type != CommentToken {
+				code = append(code, t)
+			}
+		}
+		node, err := ParseTree(code)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if node.Type != ListNode || len(node.Children) == 0 {
+			return nil, nil, nil, BadSyntaxAt(node.Pos)
+		}
+		form := configForm{Node: node, Comments: pending}
+		if commented {
+			form = commentedForm(form, current, lines)
+		}
+		forms = append(forms, form)
+		pending = make([]string, 0)
+		current = make([]Token, 0)
+		commented = false
+		lastLine = token.Pos.Line
+	}
+	if depth != 0 && len(current) > 0 {
+		return nil, nil, nil, &SyntaxError{Pos: current[0].Pos, Err: DanglingListError}
+	}
+	return header, forms, pending, nil
+}
+
+func formatPackageForm(node Node, width int) string {
+	name := PrintNode(node.Children[1])
+	if len(node.Children) == 2 {
+		return PrintNode(node)
+	}
+	options := make([]string, 0)
+	for _, opt := range node.Children[2:] {
+		options = append(options, PrintNode(opt))
+	}
+	return "(" + PrintNode(node.Children[0]) + " " +
+		name + strings.Repeat(" ", width-len(name)) + " " +
+		strings.Join(options, " ") + ")"
+}
+
+func writeConfigForm(buf *bytes.Buffer, form configForm, text string) {
+	for _, c := range form.Comments {
+		buf.WriteString(c + "\n")
+	}
+	buf.WriteString(text)
+	if form.Trailing != "" {
+		buf.WriteString(" " + form.Trailing)
+	}
+	buf.WriteString("\n")
+}
+
+// sortConfigForms puts forms in canonical order. Directives are never
+// moved across an include, since later directives override what an
+// included file sets up.
+func sortConfigForms(forms []configForm) {
+
+	segment := 0
+	for i := range forms {
+		rank := directiveRank(forms[i].Node)
+		if rank < 0 {
+			segment++
+		}
+		forms[i].Group = segment*10 + rank + 1
+	}
+
+	sort.SliceStable(forms, func(i, j int) bool {
+		if forms[i].Group != forms[j].Group {
+			return forms[i].Group < forms[j].Group
+		}
+		if isPackageForm(forms[i].Node) && isPackageForm(forms[j].Node) {
+			return forms[i].Node.Children[1].String < forms[j].Node.Children[1].String
+		}
+		return false
+	})
+}
+
+// renderConfigForms renders sorted forms, aligning the options of
+// package entries within each group.
+func renderConfigForms(forms []configForm) []string {
+
+	widths := make(map[int]int)
+	for _, form := range forms {
+		if isPackageForm(form.Node) && len(form.Node.Children) > 2 {
+			if w := len(PrintNode(form.Node.Children[1])); w > widths[form.Group] {
+				widths[form.Group] = w
+			}
+		}
+	}
+
+	out := make([]string, 0)
+	for _, form := range forms {
+		switch {
+		case form.Text != "":
+			out = append(out, form.Text)
+		case form.Body != nil:
+			out = append(out, formatProfileBody(form))
+		case isPackageForm(form.Node):
+			out = append(out, formatPackageForm(form.Node, widths[form.Group]))
+		case directiveRank(form.Node) == 6 && len(form.Node.Children) > 2:
+			out = append(out, formatProfileForm(form.Node))
+		default:
+			out = append(out, PrettyPrintNode(form.Node, DefaultWidth))
+		}
+	}
+	return out
+}
+
+func formatProfileForm(node Node) string {
+	body := make([]configForm, 0)
+	for _, child := range node.Children[2:] {
+		body = append(body, configForm{Node: child})
+	}
+	sortConfigForms(body)
+	lines := renderConfigForms(body)
+	return "(" + PrintNode(node.Children[0]) + " " + PrintNode(node.Children[1]) +
+		"\n  " + strings.Join(lines, "\n  ") + ")"
+}
+
+// formatProfileBody formats a profile block holding comments, each
+// kept with the directive it precedes or follows on the same line.
+func formatProfileBody(form configForm) string {
+	sortConfigForms(form.Body)
+	texts := renderConfigForms(form.Body)
+	buf := bytes.NewBufferString("(" + PrintNode(form.Node.Children[0]) + " " +
+		PrintNode(form.Node.Children[1]))
+	if form.Opening != "" {
+		buf.WriteString(" " + form.Opening)
+	}
+	for i, child := range form.Body {
+		for _, c := range child.Comments {
+			buf.WriteString("\n  " + c)
+		}
+		buf.WriteString("\n  " + texts[i])
+		if child.Trailing != "" {
+			buf.WriteString(" " + child.Trailing)
+		}
+	}
+	for _, c := range form.Footer {
+		buf.WriteString("\n  " + c)
+	}
+	// A closing parenthesis after a comment would be commented out
+	last := len(form.Body) - 1
+	if len(form.Footer) > 0 || (last >= 0 && form.Body[last].Trailing != "") {
+		buf.WriteString("\n")
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
+// FormatConfig rewrites an Emenv file canonically. Comments are kept
+// with the directive they precede, repository directives are grouped
+// first, package and theme entries are sorted by name and their
+// options aligned. A directive holding comments is left as written,
+// except for profile blocks, whose directives are formatted in turn.
+func FormatConfig(body []byte) ([]byte, error) {
+
+	tk := NewCommentTokenizer(body)
+	tokens, err := tk.Tokenize()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([][]rune, 0)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines = append(lines, []rune(line))
+	}
+	header, forms, footer, err := splitConfigForms(tokens, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	sortConfigForms(forms)
+	texts := renderConfigForms(forms)
+
+	buf := bytes.NewBufferString("")
+	for _, c := range header {
+		buf.WriteString(c + "\n")
+	}
+	for i, form := range forms {
+		if (i == 0 && len(header) > 0) || (i > 0 && form.Group != forms[i-1].Group) {
+			buf.WriteString("\n")
+		}
+		writeConfigForm(buf, form, texts[i])
+	}
+	if len(footer) > 0 {
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		for _, c := range footer {
+			buf.WriteString(c + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
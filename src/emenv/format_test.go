@@ -0,0 +1,60 @@
+package emenv
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// TestFormatConfig formats each testdata/fmt/*.in file, comparing the
+// result with the .golden file next to it, and checks that formatting
+// it again changes nothing.
+func TestFormatConfig(t *testing.T) {
+
+	inputs, err := filepath.Glob(filepath.Join("testdata", "fmt", "*.in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no test files")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".in")
+		t.Run(name, func(t *testing.T) {
+			body, err := ioutil.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := FormatConfig(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := strings.TrimSuffix(input, ".in") + ".golden"
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("formatted as:\n%s\nwant:\n%s", got, want)
+			}
+
+			again, err := FormatConfig(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(got) {
+				t.Errorf("formatting again gives:\n%s", again)
+			}
+		})
+	}
+}
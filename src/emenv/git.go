@@ -0,0 +1,173 @@
+package emenv
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func runGit(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, GitError(args, strings.TrimSpace(stderr.String()), err)
+	}
+	return out, nil
+}
+
+func (env *Env) GitMirrorDir(url string) string {
+	return filepath.Join(env.Cache.Dir, "git", hashBytes([]byte(url)))
+}
+
+func (env *Env) GitMirror(url string) (string, error) {
+	return env.GitMirrorContext(context.Background(), url)
+}
+
+// GitMirrorContext returns a bare mirror of a git repository kept in
+// the shared cache, cloning it or fetching new commits as needed. Git
+// is killed once ctx is done.
+func (env *Env) GitMirrorContext(ctx context.Context, url string) (string, error) {
+
+	dir := env.GitMirrorDir(url)
+	_, local := LocalPath(url)
+
+	if FileExists(dir) {
+		if env.Options.Offline && !local {
+			return dir, nil
+		}
+		env.notify(GitActivity{Op: "updating", URL: url})
+		_, err := runGit(ctx, "--git-dir", dir, "fetch", "--quiet", "--prune", "origin")
+		return dir, err
+	}
+
+	if env.Options.Offline && !local {
+		return "", &OfflineError{Missing: []string{url}}
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", err
+	}
+	env.notify(GitActivity{Op: "cloning", URL: url})
+	tmp := fmt.Sprintf("%s.%d.tmp", dir, os.Getpid())
+	if _, err := runGit(ctx, "clone", "--quiet", "--mirror", url, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return dir, os.Rename(tmp, dir)
+}
+
+func GitCommit(mirror string, ref string) (string, error) {
+	return GitCommitContext(context.Background(), mirror, ref)
+}
+
+// GitCommitContext resolves a branch, tag or commit to a full commit
+// hash, HEAD being used when ref is empty.
+func GitCommitContext(ctx context.Context, mirror string, ref string) (string, error) {
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	out, err := runGit(ctx, "--git-dir", mirror, "rev-parse", "--verify", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pinnedCommit is the commit a git package was previously installed
+// at, as long as its repository and ref did not change since.
+func (env *Env) pinnedCommit(pdef PackageDef) (string, bool) {
+	prev, ok := env.Previous[pdef.Name]
+	if !ok || env.Options.Update || len(prev.Commit) == 0 ||
+		prev.Repo != "git" || prev.URL != Redact(pdef.Git) || prev.Ref != pdef.Ref {
+		return "", false
+	}
+	return prev.Commit, true
+}
+
+func gitHasCommit(ctx context.Context, mirror string, commit string) bool {
+	_, err := runGit(ctx, "--git-dir", mirror, "cat-file", "-e", commit+"^{commit}")
+	return err == nil
+}
+
+func (env *Env) GitPackage(pdef PackageDef) (Package, error) {
+	return env.GitPackageContext(context.Background(), pdef)
+}
+
+// GitPackageContext describes a package from the files of a commit,
+// which is recorded in the package so that installs are reproducible.
+// The commit previously installed is kept unless updating.
+func (env *Env) GitPackageContext(ctx context.Context, pdef PackageDef) (Package, error) {
+
+	commit, pinned := env.pinnedCommit(pdef)
+	mirror := env.GitMirrorDir(pdef.Git)
+	var err error
+	if !pinned || !FileExists(mirror) || !gitHasCommit(ctx, mirror, commit) {
+		if mirror, err = env.GitMirrorContext(ctx, pdef.Git); err != nil {
+			return Package{}, err
+		}
+	}
+	if !pinned {
+		commit = pdef.Ref
+	}
+	if commit, err = GitCommitContext(ctx, mirror, commit); err != nil {
+		return Package{}, err
+	}
+	pkg, err := PackageFromSources(pdef.Name, func(file string) ([]byte, error) {
+		return runGit(ctx, "--git-dir", mirror, "show", commit+":"+file)
+	})
+	if err != nil {
+		return Package{}, err
+	}
+	pkg.Type = GitStorage
+	pkg.URL = pdef.Git
+	pkg.Commit = commit
+	return pkg, nil
+}
+
+func (env *Env) GitArchive(idef InstallDef) ([]byte, error) {
+	return env.GitArchiveContext(context.Background(), idef)
+}
+
+// GitArchiveContext produces a tar package of the recorded commit of
+// a package, laid out as ELPA tar packages are.
+func (env *Env) GitArchiveContext(ctx context.Context, idef InstallDef) ([]byte, error) {
+
+	// The mirror was brought up to date while resolving
+	mirror := env.GitMirrorDir(idef.URL)
+	if !FileExists(mirror) {
+		if _, err := env.GitMirrorContext(ctx, idef.URL); err != nil {
+			return nil, err
+		}
+	}
+	env.notify(GitActivity{Op: "checking out", URL: idef.URL, Commit: idef.Commit})
+	prefix := fmt.Sprintf("%s-%s/", idef.Name, idef.Version)
+	return runGit(ctx, "--git-dir", mirror, "archive", "--format=tar", "--prefix="+prefix, idef.Commit)
+}
+
+func (env *Env) FetchGitPackage(idef InstallDef) error {
+	return env.FetchGitPackageContext(context.Background(), idef)
+}
+
+// FetchGitPackageContext extracts the recorded commit of a package
+// from its mirror into the package directory.
+func (env *Env) FetchGitPackageContext(ctx context.Context, idef InstallDef) error {
+	return env.fetchGitPackage(ctx, env.PackageDir, idef)
+}
+
+func (env *Env) fetchGitPackage(ctx context.Context, root string, idef InstallDef) error {
+
+	out, err := env.GitArchiveContext(ctx, idef)
+	if err != nil {
+		return err
+	}
+	return env.extractTar(root, idef, tar.NewReader(bytes.NewReader(out)))
+}
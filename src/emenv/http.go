@@ -0,0 +1,402 @@
+package emenv
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds each attempt at an HTTP request, unless
+// configured otherwise.
+const DefaultTimeout = 60 * time.Second
+
+// DefaultRetries is how many times a request failing for a transient
+// reason is retried.
+const DefaultRetries = 3
+
+// A Client performs the HTTP requests of emenv: it goes through the
+// proxies configured in the environment, fails on error statuses and
+// retries transient failures with an exponential backoff.
+type Client struct {
+	HTTP    *http.Client
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+	tls     *tls.Config
+	certs   map[string]*http.Client
+
+	// Downloads are written to PartialDir as they progress, so that
+	// interrupted ones resume where they stopped.
+	PartialDir string
+	Observer   Observer
+
+	// Offline makes every request fail with an OfflineError, without
+	// touching the network.
+	Offline bool
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+}
+
+func NewClient(opts Options) (*Client, error) {
+
+	tlsConfig := &tls.Config{}
+	if len(opts.CABundle) > 0 {
+		pem, err := ioutil.ReadFile(opts.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, BadCABundleError(opts.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	retries := opts.Retries
+	if retries < 0 {
+		retries = 0
+	}
+	return &Client{
+		HTTP:     &http.Client{Transport: newTransport(tlsConfig)},
+		Timeout:  timeout,
+		Retries:  retries,
+		Backoff:  500 * time.Millisecond,
+		tls:      tlsConfig,
+		certs:    make(map[string]*http.Client),
+		Observer: opts.Observer,
+		Offline:  opts.Offline,
+	}, nil
+}
+
+// clientFor returns the HTTP client presenting the certificate auth
+// asks for, if any.
+func (c *Client) clientFor(auth *SourceAuth) (*http.Client, error) {
+
+	if auth == nil || len(auth.CertFile) == 0 {
+		return c.HTTP, nil
+	}
+	key := auth.CertFile + "\x00" + auth.KeyFile
+	if client, ok := c.certs[key]; ok {
+		return client, nil
+	}
+	cert, err := tls.LoadX509KeyPair(auth.CertFile, auth.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := c.tls.Clone()
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	client := &http.Client{Transport: newTransport(tlsConfig)}
+	c.certs[key] = client
+	return client, nil
+}
+
+// A StatusError reports a response whose status is not a success.
+type StatusError struct {
+	URL        string
+	Status     string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Fetching %s failed: %s", Redact(e.URL), e.Status)
+}
+
+// transient tells whether a failed request may succeed when retried.
+func transient(err error) bool {
+
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.StatusCode == http.StatusTooManyRequests || serr.StatusCode >= 500
+	}
+	// Certificates will not get any more valid by retrying
+	var cerr *tls.CertificateVerificationError
+	if errors.As(err, &cerr) {
+		return false
+	}
+	var derr *net.DNSError
+	if errors.As(err, &derr) && derr.IsNotFound {
+		return false
+	}
+	// Malformed URLs and unsupported schemes are network errors too,
+	// but only timeouts and dropped connections are worth retrying
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	if connectionDropped(err) {
+		return true
+	}
+	// Connections dropped in the middle of a body
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// maxRetryAfter bounds how long a server may have requests delayed.
+const maxRetryAfter = time.Minute
+
+// retryAfter reads the delay a response asks for, given either in
+// seconds or as the date to retry at.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	wait := time.Duration(0)
+	if secs, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	}
+	switch {
+	case wait < 0:
+		return 0
+	case wait > maxRetryAfter:
+		return maxRetryAfter
+	}
+	return wait
+}
+
+func (c *Client) get(ctx context.Context, rawurl string, timeout time.Duration, auth *SourceAuth) ([]byte, error) {
+
+	client, err := c.clientFor(auth)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.Authorize(req); err != nil {
+		return nil, err
+	}
+	if len(c.PartialDir) == 0 {
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if err := checkStatus(rawurl, resp); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = c.transfer(rawurl, &buf, resp, 0)
+		return buf.Bytes(), err
+	}
+	return c.resume(rawurl, client, req)
+}
+
+func checkStatus(rawurl string, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{URL: rawurl, Status: resp.Status,
+			StatusCode: resp.StatusCode, RetryAfter: retryAfter(resp)}
+	}
+	return nil
+}
+
+func (c *Client) notify(ev Event) {
+	if c.Observer != nil {
+		c.Observer.Notify(ev)
+	}
+}
+
+// progressWriter reports the bytes written to it as the progress of
+// a download.
+type progressWriter struct {
+	client *Client
+	url    string
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	w.client.notify(DownloadProgressed{URL: w.url, Bytes: int64(len(b))})
+	return len(b), nil
+}
+
+// transfer copies the body of resp to w, reporting its progress.
+func (c *Client) transfer(rawurl string, w io.Writer, resp *http.Response, offset int64) error {
+	size := int64(-1)
+	if resp.ContentLength >= 0 {
+		size = offset + resp.ContentLength
+	}
+	if c.Observer == nil {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+	c.notify(DownloadStarted{URL: rawurl, Offset: offset, Size: size})
+	_, err := io.Copy(io.MultiWriter(w, progressWriter{c, rawurl}), resp.Body)
+	c.notify(DownloadFinished{URL: rawurl, Err: err})
+	return err
+}
+
+// resume downloads rawurl into a .partial file, asking only for the
+// bytes missing from it when a previous attempt was interrupted. The
+// validator of the resource is kept next to it, so that the download
+// starts over when the resource changed in between. As the partial
+// directory is shared by every environment, the file is locked while
+// downloading, a run downloading the same URL waiting for the other.
+func (c *Client) resume(rawurl string, client *http.Client, req *http.Request) ([]byte, error) {
+
+	partial := filepath.Join(c.PartialDir, hashBytes([]byte(rawurl))+".partial")
+	lock, err := AcquireLock(req.Context(), partial+".lock", -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+	return c.download(rawurl, client, req, partial)
+}
+
+// contentRangeStart returns where the body of a 206 response starts
+// in the resource, from its "bytes start-end/size" Content-Range.
+func contentRangeStart(resp *http.Response) (int64, bool) {
+
+	cr := resp.Header.Get("Content-Range")
+	if !strings.HasPrefix(cr, "bytes ") {
+		return 0, false
+	}
+	cr = strings.TrimPrefix(cr, "bytes ")
+	end := strings.IndexByte(cr, '-')
+	if end < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(cr[:end], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// download does the work of resume once the partial file is locked.
+func (c *Client) download(rawurl string, client *http.Client, req *http.Request, partial string) ([]byte, error) {
+
+	validator := partial + ".validator"
+
+	offset := int64(0)
+	if st, err := os.Stat(partial); err == nil && st.Size() > 0 {
+		if v, err := ioutil.ReadFile(validator); err == nil && len(v) > 0 {
+			offset = st.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", string(v))
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	start, ranged := contentRangeStart(resp)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && ranged && start == offset:
+		flags = os.O_WRONLY | os.O_APPEND
+	case (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) && offset > 0:
+		// The partial file does not match the resource anymore, or the
+		// server sent other bytes than the missing ones
+		resp.Body.Close()
+		os.Remove(partial)
+		os.Remove(validator)
+		req.Header.Del("Range")
+		req.Header.Del("If-Range")
+		return c.download(rawurl, client, req, partial)
+	default:
+		if err := checkStatus(rawurl, resp); err != nil {
+			return nil, err
+		}
+		offset = 0
+	}
+
+	v := resp.Header.Get("ETag")
+	if len(v) == 0 || strings.HasPrefix(v, "W/") {
+		v = resp.Header.Get("Last-Modified")
+	}
+	if err := ioutil.WriteFile(validator, []byte(v), 0644); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = c.transfer(rawurl, f, resp, offset)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadFile(partial)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(partial)
+	os.Remove(validator)
+	return body, nil
+}
+
+func (c *Client) Get(rawurl string, timeout time.Duration, auth *SourceAuth) ([]byte, error) {
+	return c.GetContext(context.Background(), rawurl, timeout, auth)
+}
+
+// GetContext reads rawurl with the credentials of auth, which may be nil,
+// each attempt being given timeout, or the timeout of the client
+// when zero. No more attempts are made once ctx is done.
+func (c *Client) GetContext(ctx context.Context, rawurl string, timeout time.Duration, auth *SourceAuth) ([]byte, error) {
+
+	if c.Offline {
+		return nil, &OfflineError{Missing: []string{rawurl}}
+	}
+	if timeout == 0 {
+		timeout = c.Timeout
+	}
+	delay := c.Backoff
+	for attempt := 0; ; attempt++ {
+		body, err := c.get(ctx, rawurl, timeout, auth)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err == nil || attempt >= c.Retries || !transient(err) {
+			return body, err
+		}
+		wait := delay
+		var serr *StatusError
+		if errors.As(err, &serr) && serr.RetryAfter > wait {
+			wait = serr.RetryAfter
+		}
+		c.notify(RequestRetried{URL: rawurl, Wait: wait, Err: err})
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+	return nil, UnreachableError
+}
@@ -0,0 +1,171 @@
+package emenv
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testClient returns a client retrying quickly, writing its partial
+// downloads to dir when it is not empty.
+func testClient(t *testing.T, dir string) *Client {
+	t.Helper()
+	c, err := NewClient(Options{Timeout: 5 * time.Second, Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backoff = time.Millisecond
+	c.PartialDir = dir
+	return c
+}
+
+// TestResumeBadContentRange starts over when a server answers a range
+// request with bytes which do not follow the partial file.
+func TestResumeBadContentRange(t *testing.T) {
+
+	const body = "0123456789"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if len(r.Header.Get("Range")) > 0 {
+			w.Header().Set("Content-Range", "bytes 2-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(body[2:]))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	c := testClient(t, dir)
+	partial := filepath.Join(dir, hashBytes([]byte(srv.URL))+".partial")
+	if err := ioutil.WriteFile(partial, []byte(body[:4]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(partial+".validator", []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.Get(srv.URL, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("got %q, want %q", got, body)
+	}
+}
+
+// countingServer answers each request with the next of responses,
+// the last one being repeated, and counts the requests.
+func countingServer(t *testing.T, responses ...func(w http.ResponseWriter)) (*httptest.Server, *int) {
+	t.Helper()
+	count := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := count
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+		count++
+		responses[i](w)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &count
+}
+
+func status(code int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+
+	srv, count := countingServer(t, status(http.StatusNotFound))
+	_, err := testClient(t, "").Get(srv.URL, 0, nil)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusNotFound {
+		t.Fatalf("got error %v, want a 404 *StatusError", err)
+	}
+	if *count != 1 {
+		t.Errorf("made %d requests, want no retry", *count)
+	}
+}
+
+func TestGetRetriesServerErrors(t *testing.T) {
+
+	srv, count := countingServer(t, status(http.StatusServiceUnavailable),
+		status(http.StatusBadGateway), status(http.StatusOK))
+	body, err := testClient(t, "").Get(srv.URL, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "OK" {
+		t.Errorf("got %q", body)
+	}
+	if *count != 3 {
+		t.Errorf("made %d requests, want 3", *count)
+	}
+
+	// Retries are bounded
+	srv, count = countingServer(t, status(http.StatusInternalServerError))
+	if _, err := testClient(t, "").Get(srv.URL, 0, nil); err == nil {
+		t.Fatal("a failing server was reported as a success")
+	}
+	if *count != 3 {
+		t.Errorf("made %d requests, want 3", *count)
+	}
+}
+
+func TestGetTooManyRequests(t *testing.T) {
+
+	srv, count := countingServer(t, status(http.StatusTooManyRequests, "Retry-After", "1"),
+		status(http.StatusOK))
+	c := testClient(t, "")
+	waits := make([]time.Duration, 0)
+	c.Observer = ObserverFunc(func(ev Event) {
+		if retried, ok := ev.(RequestRetried); ok {
+			waits = append(waits, retried.Wait)
+		}
+	})
+	if _, err := c.Get(srv.URL, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *count != 2 || len(waits) != 1 || waits[0] != time.Second {
+		t.Errorf("made %d requests waiting %v, want one retry after 1s", *count, waits)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+
+	date := func(d time.Duration) string {
+		return time.Now().Add(d).UTC().Format(http.TimeFormat)
+	}
+	cases := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"garbage", 0, 0},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"-5", 0, 0},
+		{"3600", maxRetryAfter, maxRetryAfter},
+		{date(30 * time.Second), 28 * time.Second, 30 * time.Second},
+		{date(-time.Hour), 0, 0},
+		{date(time.Hour), maxRetryAfter, maxRetryAfter},
+	}
+	for _, tc := range cases {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", tc.value)
+		if got := retryAfter(resp); got < tc.min || got > tc.max {
+			t.Errorf("Retry-After %q waits %s, want between %s and %s", tc.value, got, tc.min, tc.max)
+		}
+	}
+}
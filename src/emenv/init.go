@@ -4,20 +4,11 @@ import (
 	"os"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 )
 
 func LoadEnv(path string, opts Options) (*Env, error) {
 
-	body, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	tokens, err := ParseTokens(body)
-	if err != nil {
-		return nil, err
-	}
-
 	sources := make(map[string]Source)
 
 	sources["melpa-stable"] = Source{Name: "melpa-stable", URL: "http://stable.melpa.org/packages"}
@@ -50,27 +41,23 @@ func LoadEnv(path string, opts Options) (*Env, error) {
 		Packages:    packages,
 		InstallSet:  NewInstallSet(),
 		Options:     opts,
+		Observer:    opts.Observer,
+		Prompter:    opts.Prompter,
 	}
 
 
-	for {
-		tree, err := ParseForm(&tokens)
-		if err != nil {
-			return nil, err
-		}
-
-		if tree.Type == EOFNode {
-			break
-		}
+	err := env.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
 
-		if tree.Type != ListNode {
-			return nil, BadSyntaxError
-		}
-		err = env.AddToConfig(tree.Children)
-		if err != nil {
-			return nil, err
+	problems := SortProblems(append(env.ConfigProblems, env.Validate()...))
+	for _, problem := range problems {
+		if !problem.Warning {
+			return nil, ValidationError{Problems: problems}
 		}
 	}
+	env.Warnings = problems
 
 	for sname, _ := range(sources) {
 		found := false
@@ -85,7 +72,20 @@ func LoadEnv(path string, opts Options) (*Env, error) {
 		}
 	}
 
-	bdir := os.ExpandEnv("${PWD}/.emenv")
+	bdir := env.BaseDir
+	if len(opts.BaseDir) > 0 {
+		bdir = opts.BaseDir
+	}
+	if len(bdir) == 0 {
+		bdir, err = DefaultBaseDir(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	bdir, err = filepath.Abs(bdir)
+	if err != nil {
+		return nil, err
+	}
 	adir := fmt.Sprintf("%s/archives/", bdir)
 	pdir := fmt.Sprintf("%s/packages/", bdir)
 	err = os.MkdirAll(adir, 0755)
@@ -100,5 +100,70 @@ func LoadEnv(path string, opts Options) (*Env, error) {
 	env.BaseDir = bdir
 	env.PackageDir = pdir
 	env.Repositories = make(map[string]Repository)
+
+	cdir := opts.CacheDir
+	if len(cdir) == 0 {
+		cdir = CacheHome()
+	}
+	csize := opts.CacheSize
+	if csize == 0 {
+		csize = DefaultCacheSize
+	}
+	env.Cache = NewCache(cdir, csize)
+	// The Emenv file may have turned offline mode on
+	if env.Client, err = NewClient(env.Options); err != nil {
+		return nil, err
+	}
+	env.Client.PartialDir = filepath.Join(cdir, "partial")
+	env.Fetcher = DefaultFetcher(env.Client, &env.Cache)
 	return &env, nil
 }
+
+// LoadConfig reads an Emenv file into the environment. Files pulled
+// in with include are read in place, so that directives they contain
+// are merged exactly as if they had been written at that point.
+func (env *Env) LoadConfig(path string) error {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	env.Loading = append(env.Loading, abs)
+	defer func() { env.Loading = env.Loading[:len(env.Loading)-1] }()
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := ParseFileTokens(path, body)
+	if err != nil {
+		return err
+	}
+
+	for {
+		tree, err := ParseForm(&tokens)
+		if err != nil {
+			return err
+		}
+
+		if tree.Type == EOFNode {
+			return nil
+		}
+
+		if tree.Type != ListNode || len(tree.Children) == 0 {
+			err = BadSyntaxAt(tree.Pos)
+		} else {
+			err = env.AddToConfig(tree.Children)
+		}
+		// Mistakes within a directive do not prevent reading the
+		// next ones, so that they are all reported at once
+		if problem, ok := configProblem(err); ok {
+			env.ConfigProblems = append(env.ConfigProblems, problem)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
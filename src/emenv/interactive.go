@@ -3,13 +3,29 @@ package emenv
 import (
 	"bufio"
 	"fmt"
-	"os"
+	"io"
 )
 
-func Confirm() bool {
-	reader := bufio.NewReader(os.Stdin)
+// A Prompter asks the user whether to go on with an operation.
+type Prompter interface {
+	Confirm(question string) bool
+}
+
+// TextPrompter asks its questions on Out and reads the answer from In,
+// an empty answer meaning yes.
+type TextPrompter struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+func NewTextPrompter(in io.Reader, out io.Writer) *TextPrompter {
+	return &TextPrompter{In: in, Out: out}
+}
+
+func (p *TextPrompter) Confirm(question string) bool {
+	reader := bufio.NewReader(p.In)
 
-	fmt.Print("Proceed? [Y/n]: ")
+	fmt.Fprintf(p.Out, "%s [Y/n]: ", question)
 	r, _, err := reader.ReadRune()
 
 	if err != nil {
@@ -18,3 +34,15 @@ func Confirm() bool {
 
 	return (r == 'Y' || r == 'y' || r == '\n')
 }
+
+// Confirm asks the prompter of the environment whether to proceed.
+// Without -y nor a prompter to ask, it declines.
+func (env *Env) Confirm() bool {
+	if env.Options.ImplicitYes {
+		return true
+	}
+	if env.Prompter == nil {
+		return false
+	}
+	return env.Prompter.Confirm("Proceed?")
+}
@@ -0,0 +1,168 @@
+package emenv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var headerRegexp = regexp.MustCompile(`^;+\s*([A-Za-z-]+)\s*:\s*(.*?)\s*$`)
+
+// ReadPackageHeaders collects the ";; Key: value" lines found in the
+// header of an emacs-lisp file.
+func ReadPackageHeaders(body []byte) map[string]string {
+
+	headers := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) > 0 && line[0] != ';' {
+			break
+		}
+		if m := headerRegexp.FindStringSubmatch(line); m != nil {
+			if _, ok := headers[m[1]]; !ok {
+				headers[m[1]] = m[2]
+			}
+		}
+	}
+	return headers
+}
+
+// PackageFromDefine reads the (define-package name version desc
+// requirements) form of a -pkg.el file.
+func PackageFromDefine(body []byte) (Package, error) {
+
+	tokens, err := ParseTokens(body)
+	if err != nil {
+		return Package{}, err
+	}
+	node, err := ParseForm(&tokens)
+	if err != nil {
+		return Package{}, err
+	}
+	if node.Type != ListNode || len(node.Children) < 3 ||
+		node.Children[0].Type != SymbolNode ||
+		node.Children[0].String != "define-package" ||
+		node.Children[1].Type != StringNode ||
+		node.Children[2].Type != StringNode {
+		return Package{}, BadSyntaxAt(node.Pos)
+	}
+
+	version, err := VersionFromString(node.Children[2].String)
+	if err != nil {
+		return Package{}, BadVersionAt(node.Children[2].Pos, node.Children[2].String)
+	}
+	pkg := Package{Name: node.Children[1].String, Version: version}
+	if len(node.Children) > 3 && node.Children[3].Type == StringNode {
+		pkg.Desc = node.Children[3].String
+	}
+	if len(node.Children) > 4 {
+		deps, err := RequirementsFromAST(node.Children[4])
+		if err != nil {
+			return Package{}, err
+		}
+		pkg.Dependencies = deps
+	}
+	return pkg, nil
+}
+
+// PackageFromHeaders reads the version and requirements of a package
+// from the header of its main file.
+func PackageFromHeaders(name string, body []byte) (Package, error) {
+
+	headers := ReadPackageHeaders(body)
+	pkg := Package{Name: name, Version: Version{Members: []int{0}, Literal: "0"}}
+
+	// The first line reads ";;; name.el --- description"
+	first := strings.SplitN(string(body), "\n", 2)[0]
+	if i := strings.Index(first, " --- "); i >= 0 {
+		pkg.Desc = strings.TrimSpace(strings.Split(first[i+5:], "-*-")[0])
+	}
+
+	for _, key := range []string{"Package-Version", "Version"} {
+		if literal, ok := headers[key]; ok {
+			version, err := VersionFromString(literal)
+			if err != nil {
+				return Package{}, err
+			}
+			pkg.Version = version
+			break
+		}
+	}
+
+	if requires, ok := headers["Package-Requires"]; ok {
+		tokens, err := ParseTokens([]byte(requires))
+		if err != nil {
+			return Package{}, err
+		}
+		tree, err := ParseTree(tokens)
+		if err != nil {
+			return Package{}, err
+		}
+		deps, err := RequirementsFromAST(tree)
+		if err != nil {
+			return Package{}, err
+		}
+		pkg.Dependencies = deps
+	}
+	return pkg, nil
+}
+
+// PackageFromSources describes a package from its source files, read
+// through read: from its -pkg.el file when there is one and from the
+// header of its main file otherwise.
+func PackageFromSources(name string, read func(file string) ([]byte, error)) (Package, error) {
+
+	var pkg Package
+	if body, err := read(name + "-pkg.el"); err == nil {
+		if pkg, err = PackageFromDefine(body); err != nil {
+			return Package{}, fmt.Errorf("%s-pkg.el: %w", name, err)
+		}
+	} else {
+		body, err := read(name + ".el")
+		if err != nil {
+			return Package{}, err
+		}
+		if pkg, err = PackageFromHeaders(name, body); err != nil {
+			return Package{}, fmt.Errorf("%s.el: %w", name, err)
+		}
+	}
+	pkg.Name = name
+	return pkg, nil
+}
+
+// LocalPackage describes the package held in dir.
+func LocalPackage(name string, dir string) (Package, error) {
+
+	pkg, err := PackageFromSources(name, func(file string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(dir, file))
+	})
+	if err != nil {
+		return Package{}, err
+	}
+	pkg.Type = LinkStorage
+	pkg.URL = dir
+	return pkg, nil
+}
+
+// LinkPackage makes a package developed locally available in the
+// environment through a symbolic link, so that edits take effect
+// without reinstalling.
+func (env *Env) LinkPackage(idef InstallDef) error {
+	return env.linkPackage(env.PackageDir, idef)
+}
+
+func (env *Env) linkPackage(root string, idef InstallDef) error {
+
+	env.notify(PackageLinked{Def: idef})
+	link := fmt.Sprintf("%s/%s-%s", root, idef.Name, idef.Version)
+	if err := os.RemoveAll(link); err != nil {
+		return err
+	}
+	return os.Symlink(idef.Path, link)
+}
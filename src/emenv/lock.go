@@ -0,0 +1,148 @@
+package emenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockName is the file locked in the base directory while an
+// environment is being changed.
+const LockName = "lock"
+
+// A LockHolder identifies the process holding a lock, as recorded in
+// the lock file.
+type LockHolder struct {
+	PID     int
+	Started time.Time
+}
+
+// A Lock keeps other emenv processes from changing an environment
+// until it is released. Stale is the holder recorded by a process
+// which died without releasing it, if any.
+type Lock struct {
+	Path  string
+	Stale *LockHolder
+	file  *os.File
+}
+
+var errLockBusy = errors.New("lock busy")
+
+func parseLockHolder(body []byte) (LockHolder, bool) {
+	fields := strings.Fields(string(body))
+	if len(fields) < 2 {
+		return LockHolder{}, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return LockHolder{}, false
+	}
+	started, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return LockHolder{}, false
+	}
+	return LockHolder{PID: pid, Started: started}, true
+}
+
+// readLockHolder tells which process holds the lock at path, as far
+// as its lock file says.
+func readLockHolder(path string) (LockHolder, bool) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return LockHolder{}, false
+	}
+	return parseLockHolder(body)
+}
+
+// AcquireLock locks path, creating it as needed. When another process
+// holds the lock, it fails with a *Locked error right away if wait is
+// zero, after wait otherwise, and waits until ctx is done if wait is
+// negative.
+func AcquireLock(ctx context.Context, path string, wait time.Duration, waiting func(LockHolder)) (*Lock, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for announced := false; ; announced = true {
+		f, stale, err := tryLock(path)
+		if err == nil {
+			return takeLock(path, f, stale)
+		}
+		if err != errLockBusy {
+			return nil, err
+		}
+		holder, _ := readLockHolder(path)
+		if wait == 0 || (wait > 0 && time.Now().After(deadline)) {
+			return nil, &Locked{Path: path, Holder: holder}
+		}
+		if !announced && waiting != nil {
+			waiting(holder)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// lockRecord is what a lock file holds: the PID of its holder and
+// when it took the lock.
+func lockRecord() string {
+	return fmt.Sprintf("%d %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+}
+
+// takeLock records this process as the holder of a lock it acquired,
+// noting the holder left behind by a process which crashed.
+func takeLock(path string, f *os.File, stale *LockHolder) (*Lock, error) {
+
+	lock := &Lock{Path: path, Stale: stale, file: f}
+	record := lockRecord()
+	if err := f.Truncate(0); err != nil {
+		lock.Release()
+		return nil, err
+	}
+	if _, err := f.WriteAt([]byte(record), 0); err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Release gives the lock up. Where file locks are available, the lock
+// file is emptied rather than removed, as other processes may be
+// waiting on it; elsewhere its existence is the lock, and it is
+// removed.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := unlock(l.Path, l.file)
+	l.file = nil
+	return err
+}
+
+// Lock takes the lock of the environment, waiting for it as long as
+// Options.LockWait says.
+func (env *Env) Lock(ctx context.Context) (*Lock, error) {
+
+	path := filepath.Join(env.BaseDir, LockName)
+	lock, err := AcquireLock(ctx, path, env.Options.LockWait, func(holder LockHolder) {
+		env.notify(LockWaiting{Path: path, Holder: holder})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lock.Stale != nil {
+		env.notify(Warning{Message: fmt.Sprintf("taking over stale lock left by process %d", lock.Stale.PID)})
+	}
+	return lock, nil
+}
@@ -0,0 +1,116 @@
+//go:build !unix
+
+package emenv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// lockGrace is how long a lock file may stay without a holder
+// recorded, as may happen where it cannot be written atomically, or
+// a takeover last, before it is deemed left by a crashed process.
+const lockGrace = 5 * time.Second
+
+// createLock creates the lock file at path, failing when it exists.
+// It is published complete with a hard link, so that other processes
+// never see it without its holder.
+func createLock(path string) (*os.File, error) {
+
+	record := lockRecord()
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, []byte(record), 0644); err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	err := os.Link(tmp, path)
+	if err == nil {
+		return os.OpenFile(path, os.O_RDWR, 0644)
+	}
+	if os.IsExist(err) {
+		return nil, err
+	}
+
+	// Without hard links, the lock file is written once created
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(record); err != nil {
+		unlock(path, f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// tryLock creates path exclusively, where file locks are not
+// available. A lock file left by a process which is not running
+// anymore is removed first, by a single process at a time: taking
+// over is itself guarded by a lock file.
+func tryLock(path string) (*os.File, *LockHolder, error) {
+
+	f, err := createLock(path)
+	if err == nil || !os.IsExist(err) {
+		return f, nil, err
+	}
+	if !lockStale(path) {
+		return nil, nil, errLockBusy
+	}
+
+	takeover := path + ".takeover"
+	g, err := createLock(takeover)
+	if err != nil {
+		if !os.IsExist(err) {
+			return nil, nil, err
+		}
+		// Left by a process which crashed while taking over
+		if info, err := os.Stat(takeover); err == nil && time.Since(info.ModTime()) > lockGrace {
+			os.Remove(takeover)
+		}
+		return nil, nil, errLockBusy
+	}
+	defer unlock(takeover, g)
+
+	// Another process may have taken over in the meantime
+	if !lockStale(path) {
+		return nil, nil, errLockBusy
+	}
+	holder, ok := readLockHolder(path)
+	if err := os.Remove(path); err != nil {
+		return nil, nil, err
+	}
+	f, err = createLock(path)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, nil, errLockBusy
+		}
+		return nil, nil, err
+	}
+	if !ok {
+		return f, nil, nil
+	}
+	return f, &holder, nil
+}
+
+// lockStale tells whether the lock file at path was left behind by a
+// process which is not running anymore.
+func lockStale(path string) bool {
+	if holder, ok := readLockHolder(path); ok {
+		return !processAlive(holder.PID)
+	}
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) > lockGrace
+}
+
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// unlock removes the lock file, whose existence is the lock.
+func unlock(path string, f *os.File) error {
+	f.Close()
+	return os.Remove(path)
+}
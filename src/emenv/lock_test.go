@@ -0,0 +1,69 @@
+package emenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockTwice(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), LockName)
+	ctx := context.Background()
+	lock, err := AcquireLock(ctx, path, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var locked *Locked
+	if _, err := AcquireLock(ctx, path, 0, nil); !errors.As(err, &locked) {
+		t.Fatalf("got error %v, want a *Locked", err)
+	}
+	if locked.Holder.PID != os.Getpid() {
+		t.Errorf("lock reported held by %d, want %d", locked.Holder.PID, os.Getpid())
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := AcquireLock(ctx, path, 0, nil)
+	if err != nil {
+		t.Fatalf("released lock still held: %v", err)
+	}
+	again.Release()
+}
+
+// TestLockStaleHolder takes over a lock file recording a process which
+// exited without releasing it.
+func TestLockStaleHolder(t *testing.T) {
+
+	// A process known not to be running anymore
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), LockName)
+	record := fmt.Sprintf("%d %s\n", cmd.Process.Pid, started.Format(time.RFC3339))
+	if err := ioutil.WriteFile(path, []byte(record), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := AcquireLock(context.Background(), path, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+	if lock.Stale == nil || lock.Stale.PID != cmd.Process.Pid || !lock.Stale.Started.Equal(started) {
+		t.Errorf("stale holder reported as %+v, want %d started %s", lock.Stale, cmd.Process.Pid, started)
+	}
+	if holder, ok := readLockHolder(path); !ok || holder.PID != os.Getpid() {
+		t.Errorf("lock file records %+v, want this process", holder)
+	}
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package emenv
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an flock on path. Locks of processes which died are
+// released by the kernel, so they never get in the way, but the
+// holder they recorded is returned as stale.
+func tryLock(path string) (*os.File, *LockHolder, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil, errLockBusy
+		}
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		unlock(path, f)
+		return nil, nil, err
+	}
+	if holder, ok := parseLockHolder(body); ok {
+		return f, &holder, nil
+	}
+	return f, nil, nil
+}
+
+func unlock(path string, f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
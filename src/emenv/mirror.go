@@ -0,0 +1,118 @@
+package emenv
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MirrorStatus tracks how a URL serving a source behaved during this
+// run, so that failing mirrors are tried last.
+type MirrorStatus struct {
+	URL       string
+	Served    int
+	Failures  int
+	LastError error
+}
+
+// URLs lists where a source may be fetched from: its primary URL,
+// then its mirrors.
+func (src Source) URLs() []string {
+	return append([]string{src.URL}, src.Mirrors...)
+}
+
+func (env *Env) mirrorStatus(url string) *MirrorStatus {
+	if env.Mirrors == nil {
+		env.Mirrors = make(map[string]*MirrorStatus)
+	}
+	status, ok := env.Mirrors[url]
+	if !ok {
+		status = &MirrorStatus{URL: url}
+		env.Mirrors[url] = status
+	}
+	return status
+}
+
+func (env *Env) FetchFromSource(src Source, file string) ([]byte, string, error) {
+	return env.FetchFromSourceContext(context.Background(), src, file)
+}
+
+// FetchFromSourceContext fetches file from the first URL of src able
+// to serve it, trying URLs which failed earlier in the run last. Files
+// which are missing everywhere are looked for under their compressed
+// names. It returns the URL the file was actually read from.
+func (env *Env) FetchFromSourceContext(ctx context.Context, src Source, file string) ([]byte, string, error) {
+
+	body, url, failures := env.fetchFromURLs(ctx, src, file)
+	if len(failures) == 0 {
+		return body, url, nil
+	}
+	if ctx.Err() != nil {
+		return nil, "", ctx.Err()
+	}
+	missing := true
+	for _, err := range failures {
+		missing = missing && notFound(err)
+	}
+	if missing {
+		for _, suffix := range CompressedSuffixes {
+			if body, url, errs := env.fetchFromURLs(ctx, src, file+suffix); len(errs) == 0 {
+				return body, url, nil
+			}
+		}
+	}
+	return nil, "", MirrorsFailedError(src.Name, file, failures)
+}
+
+func (env *Env) fetchFromURLs(ctx context.Context, src Source, file string) ([]byte, string, []error) {
+
+	statuses := make([]*MirrorStatus, 0)
+	for _, url := range src.URLs() {
+		statuses = append(statuses, env.mirrorStatus(url))
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Failures < statuses[j].Failures
+	})
+
+	fetch := env.Fetcher.FetchArtifact
+	if strings.HasPrefix(file, "archive-contents") {
+		fetch = env.Fetcher.FetchArchive
+	}
+	failures := make([]error, 0)
+	for _, status := range statuses {
+		url := fmt.Sprintf("%s/%s", status.URL, file)
+		body, err := fetch(ctx, src, url)
+		if err == nil {
+			status.Served++
+			return body, url, nil
+		}
+		// Cancellation is not the fault of the mirror
+		if ctx.Err() != nil {
+			return nil, "", []error{ctx.Err()}
+		}
+		env.notify(FetchFailed{URL: url, Err: err})
+		status.Failures++
+		status.LastError = err
+		failures = append(failures, err)
+	}
+	return nil, "", failures
+}
+
+func (env *Env) FetchArtifact(idef InstallDef) ([]byte, string, error) {
+	return env.FetchArtifactContext(context.Background(), idef)
+}
+
+// FetchArtifactContext fetches a package artifact from the source it
+// was resolved from, falling back on its mirrors. Artifacts stored outside
+// of the source are fetched with its timeout, and with its credentials
+// when on the same host.
+func (env *Env) FetchArtifactContext(ctx context.Context, idef InstallDef) ([]byte, string, error) {
+
+	src, ok := env.Sources[idef.Repo]
+	if !ok || !strings.HasPrefix(idef.URL, src.URL+"/") {
+		body, err := env.Fetcher.FetchArtifact(ctx, src, idef.URL)
+		return body, idef.URL, err
+	}
+	return env.FetchFromSourceContext(ctx, src, strings.TrimPrefix(idef.URL, src.URL+"/"))
+}
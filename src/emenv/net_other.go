@@ -0,0 +1,17 @@
+//go:build !unix
+
+package emenv
+
+import (
+	"errors"
+	"net"
+)
+
+// connectionDropped tells whether err is a connection refused or reset
+// by the peer, which another attempt may not meet. Error numbers differ
+// from one system to the next, so any failure to connect or to read
+// from an established connection counts.
+func connectionDropped(err error) bool {
+	var oerr *net.OpError
+	return errors.As(err, &oerr) && (oerr.Op == "dial" || oerr.Op == "read")
+}
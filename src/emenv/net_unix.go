@@ -0,0 +1,14 @@
+//go:build unix
+
+package emenv
+
+import (
+	"errors"
+	"syscall"
+)
+
+// connectionDropped tells whether err is a connection refused or reset
+// by the peer, which another attempt may not meet.
+func connectionDropped(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,95 @@
+package emenv
+
+import (
+	"fmt"
+)
+
+// An Option describes one (name arg...) form accepted after the
+// positional arguments of a directive. MaxArgs may be -1 to accept
+// any number of arguments.
+type Option struct {
+	Name    string
+	MinArgs int
+	MaxArgs int
+	Apply   func(args []Node) error
+}
+
+func arity(opt Option) string {
+	switch {
+	case opt.MinArgs == opt.MaxArgs && opt.MinArgs == 1:
+		return "exactly 1 argument"
+	case opt.MinArgs == opt.MaxArgs:
+		return fmt.Sprintf("exactly %d arguments", opt.MinArgs)
+	case opt.MaxArgs < 0:
+		return fmt.Sprintf("at least %d arguments", opt.MinArgs)
+	default:
+		return fmt.Sprintf("between %d and %d arguments", opt.MinArgs, opt.MaxArgs)
+	}
+}
+
+// ParseOptions walks the option forms given to a directive and
+// dispatches each of them to the matching Option, checking its shape
+// and arity beforehand.
+func ParseOptions(directive string, list []Node, options []Option) error {
+
+	for _, elem := range list {
+		if elem.Type != ListNode || len(elem.Children) == 0 {
+			return &OptionError{Pos: elem.Pos, Directive: directive,
+				Reason: fmt.Sprintf("expected an option form, got %s", PrintNode(elem))}
+		}
+		head := elem.Children[0]
+		if head.Type != SymbolNode {
+			return &OptionError{Pos: head.Pos, Directive: directive,
+				Reason: fmt.Sprintf("option name must be a symbol, got %s", PrintNode(head))}
+		}
+
+		var opt *Option
+		for i := range options {
+			if options[i].Name == head.String {
+				opt = &options[i]
+			}
+		}
+		if opt == nil {
+			return &OptionError{Pos: head.Pos, Directive: directive, Option: head.String,
+				Reason: "unknown option"}
+		}
+
+		args := elem.Children[1:]
+		if len(args) < opt.MinArgs || (opt.MaxArgs >= 0 && len(args) > opt.MaxArgs) {
+			return &OptionError{Pos: head.Pos, Directive: directive, Option: head.String,
+				Reason: fmt.Sprintf("expects %s, got %d", arity(*opt), len(args))}
+		}
+		if err := opt.Apply(args); err != nil {
+			if oerr, ok := err.(*OptionError); ok {
+				// Errors raised by nested options keep their context
+				if oerr.Directive == "" {
+					oerr.Directive = directive
+					oerr.Option = head.String
+				}
+				return oerr
+			}
+			return &OptionError{Pos: head.Pos, Directive: directive, Option: head.String,
+				Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// NameArg reads an option argument naming something, which may be
+// given either as a symbol or as a string.
+func NameArg(node Node) (string, error) {
+	if node.Type != SymbolNode && node.Type != StringNode {
+		return "", &OptionError{Pos: node.Pos,
+			Reason: fmt.Sprintf("expected a name, got %s", PrintNode(node))}
+	}
+	return node.String, nil
+}
+
+// StringArg reads an option argument which must be a string.
+func StringArg(node Node) (string, error) {
+	if node.Type != StringNode {
+		return "", &OptionError{Pos: node.Pos,
+			Reason: fmt.Sprintf("expected a string, got %s", PrintNode(node))}
+	}
+	return node.String, nil
+}
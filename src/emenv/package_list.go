@@ -2,6 +2,7 @@ package emenv
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -10,11 +11,11 @@ func VersionFromAST(node Node) (Version, error) {
 	members := make([]int, 0)
 	strs := make([]string, 0)
 	if len(node.Children) < 1 {
-		return Version{}, BadSyntaxError
+		return Version{}, BadSyntaxAt(node.Pos)
 	}
 	for _, child := range node.Children {
 		if child.Type != NumberNode {
-			return Version{}, BadSyntaxError
+			return Version{}, BadSyntaxAt(child.Pos)
 		}
 		members = append(members, child.Number)
 		strs = append(strs, fmt.Sprintf("%d", child.Number))
@@ -22,14 +23,174 @@ func VersionFromAST(node Node) (Version, error) {
 	return Version{Members: members, Literal: strings.Join(strs, ".")}, nil
 }
 
+// VersionFromString parses the dotted versions found in package
+// headers and -pkg.el files, such as "24.4" or "1.2.3". Parsing
+// stops at the first part which does not start with a digit, so
+// that "1.0-pre" reads as 1.0.
+func VersionFromString(s string) (Version, error) {
+
+	members := make([]int, 0)
+	for _, part := range strings.Split(strings.TrimSpace(s), ".") {
+		end := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if end < 0 {
+			end = len(part)
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			break
+		}
+		members = append(members, n)
+		if end < len(part) {
+			break
+		}
+	}
+	if len(members) == 0 {
+		return Version{}, BadVersionError(s)
+	}
+	strs := make([]string, 0)
+	for _, m := range members {
+		strs = append(strs, strconv.Itoa(m))
+	}
+	return Version{Members: members, Literal: strings.Join(strs, ".")}, nil
+}
+
+// CompareVersions returns -1, 0 or 1 as a is older than, the same as
+// or newer than b. Missing members count as zeros, so that 1.0 and 1
+// are the same version.
+func CompareVersions(a, b Version) int {
+	for i := 0; i < len(a.Members) || i < len(b.Members); i++ {
+		x, y := 0, 0
+		if i < len(a.Members) {
+			x = a.Members[i]
+		}
+		if i < len(b.Members) {
+			y = b.Members[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// ParseVersionConstraint reads constraints such as ">= 1.2", "<2" or
+// "=2.19.1". A bare version is a minimum, as in Package-Requires.
+func ParseVersionConstraint(s string) (VersionConstraint, error) {
+	s = strings.TrimSpace(s)
+	op := ">="
+	for _, candidate := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(s, candidate) {
+			op = candidate
+			s = s[len(candidate):]
+			break
+		}
+	}
+	version, err := VersionFromString(s)
+	if err != nil {
+		return VersionConstraint{}, err
+	}
+	return VersionConstraint{Op: op, Version: version}, nil
+}
+
+// Allows tells whether version v satisfies the constraint.
+func (c VersionConstraint) Allows(v Version) bool {
+	cmp := CompareVersions(v, c.Version)
+	switch c.Op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	case "=":
+		return cmp == 0
+	}
+	return false
+}
+
+func (c VersionConstraint) String() string {
+	return fmt.Sprintf("%s %s", c.Op, c.Version.Literal)
+}
+
+// Who tells what a requirement comes from.
+func (r Requirement) Who() string {
+	if len(r.By) == 0 {
+		return fmt.Sprintf("%s (%s)", ConfigName, r.Pos)
+	}
+	return fmt.Sprintf("%s %s", r.By, r.ByVersion)
+}
+
+func (r Requirement) String() string {
+	constraints := make([]string, 0)
+	for _, c := range r.Constraints {
+		constraints = append(constraints, c.String())
+	}
+	if len(constraints) == 0 {
+		return fmt.Sprintf("%s requires %s", r.Who(), r.Name)
+	}
+	return fmt.Sprintf("%s requires %s %s", r.Who(), r.Name, strings.Join(constraints, ", "))
+}
+
+// MinimumVersion is the constraint of a Package-Requires entry, none
+// when any version will do.
+func MinimumVersion(v Version) []VersionConstraint {
+	if CompareVersions(v, Version{}) == 0 {
+		return nil
+	}
+	return []VersionConstraint{{Op: ">=", Version: v}}
+}
+
+// RequirementsFromAST reads a Package-Requires list, in which
+// versions are strings: ((emacs "24.4") (dash "2.0")).
+func RequirementsFromAST(node Node) ([]PackageDef, error) {
+
+	deps := make([]PackageDef, 0)
+	if node.Type == QuoteNode {
+		node = node.Children[0]
+	}
+	if node.Type == NilNode {
+		return deps, nil
+	}
+	if node.Type != ListNode {
+		return nil, BadSyntaxAt(node.Pos)
+	}
+	for _, child := range node.Children {
+		if child.Type == SymbolNode {
+			child = NewList(child)
+		}
+		if child.Type != ListNode || len(child.Children) < 1 || len(child.Children) > 2 ||
+			child.Children[0].Type != SymbolNode {
+			return nil, BadSyntaxAt(child.Pos)
+		}
+		version := Version{Members: []int{0}, Literal: "0"}
+		if len(child.Children) == 2 {
+			if child.Children[1].Type != StringNode {
+				return nil, BadSyntaxAt(child.Children[1].Pos)
+			}
+			v, err := VersionFromString(child.Children[1].String)
+			if err != nil {
+				return nil, BadVersionAt(child.Children[1].Pos, child.Children[1].String)
+			}
+			version = v
+		}
+		deps = append(deps, PackageDef{Name: child.Children[0].String, Type: DependencyPackage, Version: version})
+	}
+	return deps, nil
+}
+
 func DependencyFromAST(node Node) (PackageDef, error) {
 
 	if node.Type != ListNode || len(node.Children) != 2 {
-		return PackageDef{}, BadSyntaxError
+		return PackageDef{}, BadSyntaxAt(node.Pos)
 	}
 	if node.Children[0].Type != SymbolNode ||
 		node.Children[1].Type != ListNode {
-		return PackageDef{}, BadSyntaxError
+		return PackageDef{}, BadSyntaxAt(node.Pos)
 	}
 	version, err := VersionFromAST(node.Children[1])
 	if err != nil {
@@ -57,18 +218,18 @@ func DependenciesFromAST(node Node) ([]PackageDef, error) {
 
 func PackageFromAST(url string, node Node) (Package, error) {
 	if len(node.Children) < 3 {
-		return Package{}, BadSyntaxError
+		return Package{}, BadSyntaxAt(node.Pos)
 	}
 
 	if node.Children[0].Type != SymbolNode ||
 		node.Children[1].Type != DotNode ||
 		node.Children[2].Type != VectorNode {
-		return Package{}, BadSyntaxError
+		return Package{}, BadSyntaxAt(node.Pos)
 	}
 
 	details := node.Children[2].Children
 	if len(details) < 4 {
-		return Package{}, BadSyntaxError
+		return Package{}, BadSyntaxAt(node.Children[2].Pos)
 	}
 
 	if details[0].Type != ListNode ||
@@ -77,7 +238,7 @@ func PackageFromAST(url string, node Node) (Package, error) {
 		details[2].Type != StringNode ||
 		details[3].Type != SymbolNode {
 
-		return Package{}, BadSyntaxError
+		return Package{}, BadSyntaxAt(node.Children[2].Pos)
 
 	}
 
@@ -103,7 +264,7 @@ func PackageFromAST(url string, node Node) (Package, error) {
 		suffix = "tar"
 		break
 	default:
-		return Package{}, BadSyntaxError
+		return Package{}, BadSyntaxAt(details[3].Pos)
 	}
 
 	pkg := Package{Name: node.Children[0].String,
@@ -120,21 +281,21 @@ func PackageFromAST(url string, node Node) (Package, error) {
 func RepositoryFromAST(name string, url string, node Node) (Repository, error) {
 
 	if node.Type != ListNode {
-		return Repository{}, BadSyntaxError
+		return Repository{}, BadSyntaxAt(node.Pos)
 	}
 
 	if len(node.Children) < 2 {
-		return Repository{}, BadSyntaxError
+		return Repository{}, BadSyntaxAt(node.Pos)
 	}
 
 	if node.Children[0].Type != NumberNode {
-		return Repository{}, BadSyntaxError
+		return Repository{}, BadSyntaxAt(node.Pos)
 	}
 
 	packages := make([]Package, 0)
 	for _, child := range node.Children[1:] {
 		if child.Type != ListNode {
-			return Repository{}, BadSyntaxError
+			return Repository{}, BadSyntaxAt(child.Pos)
 		}
 		pkg, err := PackageFromAST(url, child)
 		if err != nil {
@@ -2,179 +2,187 @@ package emenv
 
 import (
 	"fmt"
+	"io"
 )
 
-func DumpToken(token Token) {
+func DumpToken(w io.Writer, token Token) {
 	switch {
 	case token.Type == EOFToken:
-		fmt.Println("eof: <EOF>")
+		fmt.Fprintln(w, "eof: <EOF>")
 		break
 	case token.Type == NilToken:
-		fmt.Println("nil: <nil>")
+		fmt.Fprintln(w, "nil: <nil>")
 		break
 	case token.Type == NumberToken:
-		fmt.Printf("num: %d\n", token.Number)
+		fmt.Fprintf(w, "num: %d\n", token.Number)
 		break
 	case token.Type == KeywordToken:
-		fmt.Printf("kwd: :%s\n", token.String)
+		fmt.Fprintf(w, "kwd: :%s\n", token.String)
 		break
 	case token.Type == SymbolToken:
-		fmt.Printf("sym: %s\n", token.String)
+		fmt.Fprintf(w, "sym: %s\n", token.String)
 		break
 	case token.Type == StringToken:
-		fmt.Printf("str: \"%s\"\n", token.String)
+		fmt.Fprintf(w, "str: \"%s\"\n", token.String)
 		break
 	case token.Type == OpenParToken:
-		fmt.Println("par: (")
+		fmt.Fprintln(w, "par: (")
 		break
 	case token.Type == CloseParToken:
-		fmt.Println("par: )")
+		fmt.Fprintln(w, "par: )")
 		break
 	case token.Type == OpenVectorToken:
-		fmt.Println("vec: [")
+		fmt.Fprintln(w, "vec: [")
 		break
 	case token.Type == CloseVectorToken:
-		fmt.Println("vec: ]")
+		fmt.Fprintln(w, "vec: ]")
 		break
 	case token.Type == DotToken:
-		fmt.Println("dot: .")
+		fmt.Fprintln(w, "dot: .")
+		break
+	case token.Type == CommentToken:
+		fmt.Fprintf(w, "com: %s\n", token.String)
 		break
 	default:
-		fmt.Println("err:")
+		fmt.Fprintln(w, "err:")
 		break
 	}
 }
 
-func DumpTokens(tokens []Token) {
+func DumpTokens(w io.Writer, tokens []Token) {
 	for _, token := range tokens {
-		DumpToken(token)
+		DumpToken(w, token)
 	}
 }
 
-func DumpTree(node Node) {
+func DumpTree(w io.Writer, node Node) {
 	switch {
 	case node.Type == StringNode:
-		fmt.Printf("str: \"%s\"\n", node.String)
+		fmt.Fprintf(w, "str: \"%s\"\n", node.String)
 		break
 	case node.Type == KeywordNode:
-		fmt.Printf("kwd: :%s\n", node.String)
+		fmt.Fprintf(w, "kwd: :%s\n", node.String)
 		break
 	case node.Type == SymbolNode:
-		fmt.Printf("sym: %s\n", node.String)
+		fmt.Fprintf(w, "sym: %s\n", node.String)
 		break
 	case node.Type == NumberNode:
-		fmt.Printf("num: %d\n", node.Number)
+		fmt.Fprintf(w, "num: %d\n", node.Number)
 		break
 	case node.Type == NilNode:
-		fmt.Printf("nil: nil\n")
+		fmt.Fprintf(w, "nil: nil\n")
 		break
 	case node.Type == DotNode:
-		fmt.Printf("dot: .\n")
+		fmt.Fprintf(w, "dot: .\n")
+		break
+	case node.Type == QuoteNode:
+		fmt.Fprintf(w, "quo: '\n")
+		DumpTree(w, node.Children[0])
 		break
 	case node.Type == PairNode:
-		fmt.Printf("par: 0\n")
-		DumpTree(node.Children[0])
-		fmt.Printf("par: 1\n")
-		DumpTree(node.Children[1])
+		fmt.Fprintf(w, "par: 0\n")
+		DumpTree(w, node.Children[0])
+		fmt.Fprintf(w, "par: 1\n")
+		DumpTree(w, node.Children[1])
 		break
 	case node.Type == ListNode:
-		fmt.Printf("lst: (\n")
+		fmt.Fprintf(w, "lst: (\n")
 		for _, child := range node.Children {
-			DumpTree(child)
+			DumpTree(w, child)
 		}
-		fmt.Printf("lst: )\n")
+		fmt.Fprintf(w, "lst: )\n")
 		break
 	case node.Type == VectorNode:
-		fmt.Printf("vec: [\n")
+		fmt.Fprintf(w, "vec: [\n")
 		for _, child := range node.Children {
-			DumpTree(child)
+			DumpTree(w, child)
 		}
-		fmt.Printf("vec: ]\n")
+		fmt.Fprintf(w, "vec: ]\n")
 		break
 	}
 }
 
-func DumpNode(node InstallNode, depth int) {
+func DumpNode(w io.Writer, node InstallNode, depth int) {
 
 	if node.Def.Type == ShadowPackage {
 		return
 	}
 	for i := 0; i < depth; i++ {
-		fmt.Printf("  ")
+		fmt.Fprintf(w, "  ")
 	}
 	switch {
 	case node.Def.Type == RootPackage:
-		fmt.Printf("root\n")
+		fmt.Fprintf(w, "root\n")
 	case node.Def.Type == StandardPackage:
-		fmt.Printf("package %s %s from %s\n",
+		fmt.Fprintf(w, "package %s %s from %s\n",
 			node.Def.Name, node.Def.Version, node.Def.Repo)
 	case node.Def.Type == DependencyPackage:
-		fmt.Printf("dependency %s %s from %s\n",
+		fmt.Fprintf(w, "dependency %s %s from %s\n",
 			node.Def.Name, node.Def.Version, node.Def.Repo)
 	case node.Def.Type == ThemePackage:
-		fmt.Printf("theme %s %s from %s\n",
+		fmt.Fprintf(w, "theme %s %s from %s\n",
 			node.Def.Name, node.Def.Version, node.Def.Repo)
 	case node.Def.Type == ShadowPackage:
-		fmt.Printf("shadowed %s\n", node.Def.Name)
+		fmt.Fprintf(w, "shadowed %s\n", node.Def.Name)
 	case node.Def.Type == ProvidedPackage:
-		fmt.Printf("provided %s\n", node.Def.Name)
+		fmt.Fprintf(w, "provided %s\n", node.Def.Name)
 	default:
-		fmt.Printf("WHAT?\n")
+		fmt.Fprintf(w, "WHAT?\n")
 	}
 	for _, n := range node.Children {
-		DumpNode(n, depth+1)
+		DumpNode(w, n, depth+1)
 	}
 }
 
-func DumpDefs(defs map[string]InstallDef) {
+func DumpDefs(w io.Writer, defs map[string]InstallDef) {
 
 	for _, d := range defs {
 		switch {
 		case d.Type == RootPackage:
-			fmt.Printf("root\n")
+			fmt.Fprintf(w, "root\n")
 		case d.Type == StandardPackage:
-			fmt.Printf("package %s %s from %s depth %d\n",
+			fmt.Fprintf(w, "package %s %s from %s depth %d\n",
 				d.Name, d.Version, d.Repo, d.Depth)
 		case d.Type == DependencyPackage:
-			fmt.Printf("dependency %s %s from %s depth %d\n",
+			fmt.Fprintf(w, "dependency %s %s from %s depth %d\n",
 				d.Name, d.Version, d.Repo, d.Depth)
 		case d.Type == ShadowPackage:
-			fmt.Printf("shadowed %s\n", d.Name)
+			fmt.Fprintf(w, "shadowed %s\n", d.Name)
 		case d.Type == ThemePackage:
-			fmt.Printf("theme %s %s from %s depth %d\n",
+			fmt.Fprintf(w, "theme %s %s from %s depth %d\n",
 				d.Name, d.Version, d.Repo, d.Depth)
 		case d.Type == ProvidedPackage:
-			fmt.Printf("provided %s\n", d.Name)
+			fmt.Fprintf(w, "provided %s\n", d.Name)
 		default:
-			fmt.Printf("WHAT?\n")
+			fmt.Fprintf(w, "WHAT?\n")
 		}
 	}
 }
 
-func DumpDiffSet(ds DiffSet) {
+func DumpDiffSet(w io.Writer, ds DiffSet) {
 
-	fmt.Printf("Keeping %d, Upgrading %d, Deleting %d, Installing %d\n",
+	fmt.Fprintf(w, "Keeping %d, Upgrading %d, Deleting %d, Installing %d\n",
 		len(ds.Keep),
 		len(ds.Upgrade),
 		len(ds.Delete),
 		len(ds.Install))
 
-	fmt.Println("Keeping:")
+	fmt.Fprintln(w, "Keeping:")
 	for _, p := range(ds.Keep) {
-		fmt.Printf("  %s %s from %s\n", p.Name, p.Version, p.Repo)
+		fmt.Fprintf(w, "  %s %s from %s\n", p.Name, p.Version, p.Repo)
 	}
-	fmt.Println("Removing:")
+	fmt.Fprintln(w, "Removing:")
 	for _, p := range(ds.Delete) {
-		fmt.Printf("  %s %s from %s\n", p.Name, p.Version, p.Repo)
+		fmt.Fprintf(w, "  %s %s from %s\n", p.Name, p.Version, p.Repo)
 	}
-	fmt.Println("Upgrading:")
+	fmt.Fprintln(w, "Upgrading:")
 	for _, u := range(ds.Upgrade) {
-		fmt.Printf("  %s %s/%s => %s/%s\n",
+		fmt.Fprintf(w, "  %s %s/%s => %s/%s\n",
 			u.Prev.Name, u.Prev.Repo, u.Prev.Version,
 			u.Next.Repo, u.Next.Version)
 	}
-	fmt.Println("Installing:")
+	fmt.Fprintln(w, "Installing:")
 	for _, p := range(ds.Install) {
-		fmt.Printf("  %s %s from %s\n", p.Name, p.Version, p.Repo)
+		fmt.Fprintf(w, "  %s %s from %s\n", p.Name, p.Version, p.Repo)
 	}
 }
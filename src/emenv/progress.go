@@ -0,0 +1,133 @@
+package emenv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// A Progress renders downloads as they happen. On a terminal a status
+// line is redrawn in place, otherwise a plain line is printed when a
+// download starts and when it ends.
+type Progress struct {
+	Out      io.Writer
+	TTY      bool
+	Expected int
+	Started  int
+	Total    int64
+	url      string
+	name     string
+	size     int64
+	done     int64
+	begin    time.Time
+	drawn    time.Time
+}
+
+// IsTerminal tells whether f is attached to a terminal.
+func IsTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// NewProgress renders downloads to w, redrawing a status line when w
+// is a terminal.
+func NewProgress(w io.Writer) *Progress {
+	f, ok := w.(*os.File)
+	return &Progress{Out: w, TTY: ok && IsTerminal(f)}
+}
+
+// Expect announces how many downloads are about to be made, so that
+// each of them can be reported against the whole.
+func (p *Progress) Expect(n int) {
+	p.Expected = n
+	p.Started = 0
+}
+
+// FormatSize renders a number of bytes the way ParseSize reads them.
+func FormatSize(n int64) string {
+	units := []string{"K", "M", "G", "T"}
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n)
+	unit := ""
+	for _, u := range units {
+		if f < 1024 {
+			break
+		}
+		f /= 1024
+		unit = u
+	}
+	return fmt.Sprintf("%.1f%s", f, unit)
+}
+
+func (p *Progress) counter() string {
+	if p.Expected > 0 && p.Started <= p.Expected {
+		return fmt.Sprintf("[%d/%d] ", p.Started, p.Expected)
+	}
+	return ""
+}
+
+// Begin starts reporting the download of url, offset bytes of which
+// were downloaded before, size being -1 when unknown.
+func (p *Progress) Begin(url string, offset int64, size int64) {
+	// Retries of a download are not counted again
+	if url != p.url {
+		p.Started++
+	}
+	p.url = url
+	p.name = path.Base(url)
+	p.size = size
+	p.done = offset
+	p.begin = time.Now()
+	p.drawn = time.Time{}
+	if p.TTY {
+		p.draw()
+		return
+	}
+	msg := fmt.Sprintf("%sdownloading %s", p.counter(), p.name)
+	if size >= 0 {
+		msg = fmt.Sprintf("%s (%s)", msg, FormatSize(size))
+	}
+	if offset > 0 {
+		msg = fmt.Sprintf("%s, resuming at %s", msg, FormatSize(offset))
+	}
+	fmt.Fprintln(p.Out, msg)
+}
+
+func (p *Progress) draw() {
+	line := fmt.Sprintf("%s%s %s", p.counter(), p.name, FormatSize(p.done))
+	if p.size > 0 {
+		line = fmt.Sprintf("%s/%s %3d%%", line, FormatSize(p.size), p.done*100/p.size)
+	}
+	line = fmt.Sprintf("%s  total %s", line, FormatSize(p.Total))
+	fmt.Fprintf(p.Out, "\r\033[K%s", line)
+	p.drawn = time.Now()
+}
+
+// Advance accounts for n more downloaded bytes.
+func (p *Progress) Advance(n int64) {
+	p.done += n
+	p.Total += n
+	if p.TTY && time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw()
+	}
+}
+
+// End stops reporting the current download, err telling whether it
+// failed.
+func (p *Progress) End(err error) {
+	if p.TTY {
+		p.draw()
+		fmt.Fprintln(p.Out)
+	}
+	if err != nil {
+		return
+	}
+	if !p.TTY {
+		elapsed := time.Since(p.begin).Round(time.Millisecond)
+		fmt.Fprintf(p.Out, "downloaded %s, %s in %s\n", p.name, FormatSize(p.done), elapsed)
+	}
+}
@@ -0,0 +1,357 @@
+package emenv
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFilesSpec is the file selection MELPA applies to recipes
+// which do not provide :files, and which :defaults expands to.
+const DefaultFilesSpec = `("*.el" "lisp/*.el"
+  "dir" "*.info" "*.texi" "*.texinfo"
+  "doc/dir" "doc/*.info" "doc/*.texi" "doc/*.texinfo"
+  "docs/dir" "docs/*.info" "docs/*.texi" "docs/*.texinfo"
+  (:exclude ".dir-locals.el" "lisp/.dir-locals.el"
+   "test.el" "tests.el" "*-test.el" "*-tests.el"
+   "lisp/test.el" "lisp/tests.el" "lisp/*-test.el" "lisp/*-tests.el"))`
+
+func defaultFilesSpec() []Node {
+	tokens, err := ParseTokens([]byte(DefaultFilesSpec))
+	if err != nil {
+		panic(err)
+	}
+	tree, err := ParseTree(tokens)
+	if err != nil {
+		panic(err)
+	}
+	return tree.Children
+}
+
+// RecipeFromAST reads a MELPA recipe: (name :fetcher git :url "…").
+// Properties emenv has no use for are ignored.
+func RecipeFromAST(node Node) (Recipe, error) {
+
+	if node.Type != ListNode || len(node.Children) < 1 ||
+		(node.Children[0].Type != SymbolNode && node.Children[0].Type != StringNode) {
+		return Recipe{}, &OptionError{Pos: node.Pos, Directive: "recipe",
+			Reason: "expected (name :fetcher …)"}
+	}
+
+	recipe := Recipe{Name: node.Children[0].String}
+	props := node.Children[1:]
+	for i := 0; i < len(props); i += 2 {
+		if props[i].Type != KeywordNode || i+1 >= len(props) {
+			return Recipe{}, &OptionError{Pos: props[i].Pos, Directive: "recipe",
+				Reason: fmt.Sprintf("expected a property and its value, got %s", PrintNode(props[i]))}
+		}
+		key, value := props[i].String, props[i+1]
+		var err error
+		switch key {
+		case "fetcher":
+			recipe.Fetcher, err = NameArg(value)
+		case "url":
+			recipe.URL, err = StringArg(value)
+		case "repo":
+			var repo string
+			if repo, err = StringArg(value); err == nil {
+				recipe.URL = repo
+			}
+		case "branch":
+			recipe.Branch, err = StringArg(value)
+		case "commit":
+			recipe.Commit, err = StringArg(value)
+		case "files":
+			if value.Type != ListNode {
+				err = &OptionError{Pos: value.Pos, Reason: "expected a list of files"}
+			}
+			recipe.Files = value.Children
+		}
+		if err != nil {
+			if oerr, ok := err.(*OptionError); ok {
+				oerr.Directive = "recipe"
+				oerr.Option = ":" + key
+			}
+			return Recipe{}, err
+		}
+	}
+
+	hosts := map[string]string{
+		"github":    "https://github.com/%s.git",
+		"gitlab":    "https://gitlab.com/%s.git",
+		"codeberg":  "https://codeberg.org/%s.git",
+		"sourcehut": "https://git.sr.ht/~%s",
+	}
+	switch {
+	case recipe.Fetcher == "git":
+	case len(hosts[recipe.Fetcher]) > 0:
+		recipe.URL = fmt.Sprintf(hosts[recipe.Fetcher], recipe.URL)
+	default:
+		return Recipe{}, &OptionError{Pos: node.Pos, Directive: "recipe",
+			Reason: fmt.Sprintf("unsupported fetcher %q", recipe.Fetcher)}
+	}
+	if len(recipe.URL) == 0 {
+		return Recipe{}, &OptionError{Pos: node.Pos, Directive: "recipe",
+			Reason: "missing :url or :repo"}
+	}
+	return recipe, nil
+}
+
+func (env *Env) AddRecipeToConfig(directive Node, list []Node) error {
+
+	node := NewList(list...)
+	node.Pos = directive.Pos
+	if len(list) == 1 && list[0].Type == ListNode {
+		node = list[0]
+	}
+	recipe, err := RecipeFromAST(node)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(recipe.URL, "://") {
+		if recipe.URL, err = ResolvePath(directive.Pos, recipe.URL); err != nil {
+			return err
+		}
+	}
+	env.Packages = append(env.Packages, PackageDef{
+		Name:   recipe.Name,
+		Type:   StandardPackage,
+		Pos:    node.Children[0].Pos,
+		Recipe: &recipe,
+	})
+	return nil
+}
+
+// matchFile tells whether glob selects file f, either itself or one
+// of the directories holding it, and where it lands in the package.
+// Directories are included whole, keeping their layout.
+func matchFile(glob string, f string) (string, bool, error) {
+	if ok, err := path.Match(glob, f); err != nil || ok {
+		return path.Base(f), ok, err
+	}
+	parts := strings.Split(f, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		if ok, _ := path.Match(glob, dir); ok {
+			return path.Join(path.Base(dir), strings.Join(parts[i:], "/")), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// ExpandFilesSpec selects files of a source tree according to a MELPA
+// :files specification, returning a map from their destination in the
+// package to their path in the tree.
+func ExpandFilesSpec(spec []Node, files []string, prefix string) (map[string]string, error) {
+
+	selected := make(map[string]string)
+	for _, item := range spec {
+		switch {
+		case item.Type == KeywordNode && item.String == "defaults":
+			defaults, err := ExpandFilesSpec(defaultFilesSpec(), files, prefix)
+			if err != nil {
+				return nil, err
+			}
+			for dest, src := range defaults {
+				selected[dest] = src
+			}
+		case item.Type == StringNode:
+			for _, f := range files {
+				if dest, ok, err := matchFile(item.String, f); err != nil {
+					return nil, err
+				} else if ok {
+					selected[prefix+dest] = f
+				}
+			}
+		case item.Type == ListNode && len(item.Children) > 0 &&
+			item.Children[0].Type == KeywordNode && item.Children[0].String == "exclude":
+			for _, glob := range item.Children[1:] {
+				for dest, src := range selected {
+					if _, ok, _ := matchFile(glob.String, src); ok {
+						delete(selected, dest)
+					}
+				}
+			}
+		case item.Type == ListNode && len(item.Children) > 0 && item.Children[0].Type == StringNode:
+			sub, err := ExpandFilesSpec(item.Children[1:], files, prefix+item.Children[0].String+"/")
+			if err != nil {
+				return nil, err
+			}
+			for dest, src := range sub {
+				selected[dest] = src
+			}
+		default:
+			return nil, &OptionError{Pos: item.Pos, Directive: "recipe", Option: ":files",
+				Reason: fmt.Sprintf("unsupported file specification %s", PrintNode(item))}
+		}
+	}
+	return selected, nil
+}
+
+// SnapshotVersion derives a package version from a commit time, the
+// way MELPA does: 20240131.1542.
+func SnapshotVersion(t time.Time) Version {
+	t = t.UTC()
+	date, _ := strconv.Atoi(t.Format("20060102"))
+	clock, _ := strconv.Atoi(t.Format("1504"))
+	return Version{Members: []int{date, clock}, Literal: fmt.Sprintf("%d.%d", date, clock)}
+}
+
+func recipeArtifact(recipe *Recipe, commit string) string {
+	return fmt.Sprintf("recipe://%s/%s.tar?commit=%s", recipe.Name, recipe.Name, commit)
+}
+
+func (env *Env) RecipePackage(pdef PackageDef) (Package, error) {
+	return env.RecipePackageContext(context.Background(), pdef)
+}
+
+// RecipePackageContext describes the package a recipe builds at the
+// commit its branch currently points to, building the tar package into
+// the shared cache unless it was built before. It gives up when ctx is
+// done.
+func (env *Env) RecipePackageContext(ctx context.Context, pdef PackageDef) (Package, error) {
+
+	recipe := pdef.Recipe
+	mirror, err := env.GitMirrorContext(ctx, recipe.URL)
+	if err != nil {
+		return Package{}, err
+	}
+	ref := recipe.Commit
+	if len(ref) == 0 {
+		ref = recipe.Branch
+	}
+	commit, err := GitCommitContext(ctx, mirror, ref)
+	if err != nil {
+		return Package{}, err
+	}
+
+	// Names are NUL terminated, so that git neither quotes them nor
+	// lets spaces split them
+	out, err := runGit(ctx, "--git-dir", mirror, "ls-tree", "-r", "-z", "--name-only", commit)
+	if err != nil {
+		return Package{}, err
+	}
+	files := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	spec := recipe.Files
+	if spec == nil {
+		spec = defaultFilesSpec()
+	}
+	selected, err := ExpandFilesSpec(spec, files, "")
+	if err != nil {
+		return Package{}, err
+	}
+	read := func(file string) ([]byte, error) {
+		src, ok := selected[file]
+		if !ok {
+			return nil, FileNotInRecipeError(file)
+		}
+		return runGit(ctx, "--git-dir", mirror, "show", commit+":"+src)
+	}
+
+	pkg, err := PackageFromSources(recipe.Name, read)
+	if err != nil {
+		return Package{}, err
+	}
+	out, err = runGit(ctx, "--git-dir", mirror, "show", "-s", "--format=%ct", commit)
+	if err != nil {
+		return Package{}, err
+	}
+	stamp, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return Package{}, err
+	}
+	pkg.Version = SnapshotVersion(time.Unix(stamp, 0))
+	pkg.Type = TarStorage
+	pkg.URL = recipeArtifact(recipe, commit)
+	pkg.Commit = commit
+
+	if _, ok := env.Cache.Get(pkg.URL); !ok {
+		env.notify(RecipeBuilding{Name: pkg.Name, Version: pkg.Version.Literal, URL: recipe.URL})
+		body, err := BuildTarPackage(pkg, selected, read)
+		if err != nil {
+			return Package{}, err
+		}
+		if err := env.Cache.Put(pkg.URL, body); err != nil {
+			return Package{}, err
+		}
+	}
+	return pkg, nil
+}
+
+// DefinePackage renders the -pkg.el file of a package.
+func DefinePackage(pkg Package) []byte {
+
+	deps := make([]Node, 0)
+	for _, dep := range pkg.Dependencies {
+		deps = append(deps, NewList(NewSymbol(dep.Name), NewString(dep.Version.Literal)))
+	}
+	form := NewList(
+		NewSymbol("define-package"),
+		NewString(pkg.Name),
+		NewString(pkg.Version.Literal),
+		NewString(pkg.Desc),
+		NewQuote(NewList(deps...)))
+	return []byte(PrettyPrintNode(form, DefaultWidth) + "\n")
+}
+
+// BuildTarPackage produces a tar package in the layout ELPA archives
+// serve, holding the selected files and a generated -pkg.el.
+func BuildTarPackage(pkg Package, selected map[string]string, read func(string) ([]byte, error)) ([]byte, error) {
+
+	dir := fmt.Sprintf("%s-%s/", pkg.Name, pkg.Version.Literal)
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+
+	dests := make([]string, 0)
+	for dest := range selected {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	contents := make(map[string][]byte)
+	for _, dest := range dests {
+		body, err := read(dest)
+		if err != nil {
+			return nil, err
+		}
+		contents[dest] = body
+	}
+	// A -pkg.el shipped by the package is replaced to carry the
+	// snapshot version
+	if _, ok := contents[pkg.Name+"-pkg.el"]; !ok {
+		dests = append(dests, pkg.Name+"-pkg.el")
+	}
+	contents[pkg.Name+"-pkg.el"] = DefinePackage(pkg)
+
+	dirs := map[string]bool{dir: true}
+	if err := w.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		return nil, err
+	}
+	for _, dest := range dests {
+		if sub := path.Dir(dest); sub != "." && !dirs[dir+sub+"/"] {
+			dirs[dir+sub+"/"] = true
+			hdr := &tar.Header{Name: dir + sub + "/", Typeflag: tar.TypeDir, Mode: 0755}
+			if err := w.WriteHeader(hdr); err != nil {
+				return nil, err
+			}
+		}
+		body := contents[dest]
+		hdr := &tar.Header{Name: dir + dest, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}
+		if err := w.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,40 @@
+package emenv
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// TextRenderer writes events to Out the way the command line shows
+// them, downloads being rendered by Progress. It may be notified from
+// several goroutines.
+type TextRenderer struct {
+	Out      io.Writer
+	Progress *Progress
+	mu       sync.Mutex
+}
+
+func NewTextRenderer(w io.Writer) *TextRenderer {
+	return &TextRenderer{Out: w, Progress: NewProgress(w)}
+}
+
+func (r *TextRenderer) Notify(ev Event) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e := ev.(type) {
+	case DownloadsPlanned:
+		r.Progress.Expect(e.Count)
+	case DownloadStarted:
+		r.Progress.Begin(e.URL, e.Offset, e.Size)
+	case DownloadProgressed:
+		r.Progress.Advance(e.Bytes)
+	case DownloadFinished:
+		r.Progress.End(e.Err)
+	default:
+		if msg := ev.String(); len(msg) > 0 {
+			fmt.Fprintln(r.Out, msg)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package emenv
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"strings"
 )
 
 func FileExists(path string) bool {
@@ -18,23 +19,27 @@ func FileExists(path string) bool {
 }
 
 func (env *Env) FetchRepository(src Source) error {
+	return env.FetchRepositoryContext(context.Background(), src)
+}
 
-	fmt.Printf("fetching repository %s from %s\n", src.Name, src.URL)
-	contents := fmt.Sprintf("%s/archive-contents", src.URL)
+// FetchRepositoryContext fetches the archive-contents of src, giving
+// up when ctx is done. The previous archive is only replaced once the
+// new one was entirely received.
+func (env *Env) FetchRepositoryContext(ctx context.Context, src Source) error {
 
-	resp, err := http.Get(contents)
+	env.notify(RepositoryFetching{Source: src})
+	body, url, err := env.FetchFromSourceContext(ctx, src, "archive-contents")
 	if err != nil {
 		return err
 	}
-
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if !strings.HasPrefix(url, src.URL+"/") {
+		env.notify(MirrorUsed{URL: url})
+	}
+	if body, err = DecompressContext(ctx, body); err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", env.ArchiveDir, src.Name), body, 0644)
+	err = writeFileAtomic(fmt.Sprintf("%s/%s", env.ArchiveDir, src.Name), body)
 
 	if err != nil {
 		return err
@@ -43,11 +48,24 @@ func (env *Env) FetchRepository(src Source) error {
 }
 
 func (env *Env) LoadRepository(src Source) error {
+	return env.LoadRepositoryContext(context.Background(), src)
+}
+
+// LoadRepositoryContext reads the archive of src into the environment,
+// fetching it first when it was never fetched and giving up when ctx
+// is done.
+func (env *Env) LoadRepositoryContext(ctx context.Context, src Source) error {
 
 	path := fmt.Sprintf("%s/%s", env.ArchiveDir, src.Name)
 
 	if FileExists(path) == false {
-		if err := env.FetchRepository(src); err != nil {
+		if _, local := LocalPath(src.URL); env.Options.Offline && !local {
+			env.notify(RepositoryUnavailable{Source: src})
+			env.Unavailable = append(env.Unavailable,
+				fmt.Sprintf("%s/archive-contents", src.URL))
+			return nil
+		}
+		if err := env.FetchRepositoryContext(ctx, src); err != nil {
 			return err
 		}
 	}
@@ -57,27 +75,34 @@ func (env *Env) LoadRepository(src Source) error {
 		return err
 	}
 
-	tokens, err := ParseTokens(body)
+	tokens, err := ParseFileTokens(path, body)
 	if err != nil {
-		return err
+		return fmt.Errorf("Reading repository %s: %w", src.Name, err)
 	}
 
 	tree, err := ParseTree(tokens)
 	if err != nil {
-		return err
+		return fmt.Errorf("Reading repository %s: %w", src.Name, err)
 	}
-	fmt.Printf("loaded repository %s from %s\n", src.Name, path)
+	env.notify(RepositoryLoaded{Source: src, Path: path})
 	repo, err := RepositoryFromAST(src.Name, src.URL, tree)
 	if err != nil {
-		return err
+		return fmt.Errorf("Reading repository %s: %w", src.Name, err)
 	}
 	env.Repositories[repo.Name] = repo
 	return nil
 }
 
 func (env *Env) LoadRepositories() error {
+	return env.LoadRepositoriesContext(context.Background())
+}
+
+func (env *Env) LoadRepositoriesContext(ctx context.Context) error {
 	for _, src := range env.Sources {
-		if err := env.LoadRepository(src); err != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := env.LoadRepositoryContext(ctx, src); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,354 @@
+package emenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxResolveSteps bounds the search for a solution, which may take
+// exponential time when archives are pathological.
+const maxResolveSteps = 100000
+
+// A candidate is a version of a package which may be installed.
+// Pinned candidates come from a path, git repository or recipe named
+// in the Emenv file, and are used whatever other packages require.
+type candidate struct {
+	Repo   string
+	Pkg    Package
+	Pinned bool
+}
+
+// resolveState is a partial solution: the packages selected so far,
+// what is required of every package met, and the order in which
+// packages were met.
+type resolveState struct {
+	selected map[string]candidate
+	required map[string][]Requirement
+	queue    []string
+}
+
+func (s *resolveState) clone() *resolveState {
+	next := &resolveState{
+		selected: make(map[string]candidate),
+		required: make(map[string][]Requirement),
+		queue:    append([]string(nil), s.queue...),
+	}
+	for name, c := range s.selected {
+		next.selected[name] = c
+	}
+	for name, reqs := range s.required {
+		next.required[name] = append([]Requirement(nil), reqs...)
+	}
+	return next
+}
+
+// resolver searches depth-first for a version of every package such
+// that all requirements hold, backtracking on conflicts. Candidates
+// are tried in the preference order of repositories, newest first.
+type resolver struct {
+	env        *Env
+	declared   map[string]PackageDef
+	candidates map[string][]candidate
+	steps      int
+	// failure is the first conflict met, which best explains why
+	// the preferred versions could not be used
+	failure error
+}
+
+func newResolver(env *Env) *resolver {
+	r := &resolver{
+		env:        env,
+		declared:   make(map[string]PackageDef),
+		candidates: make(map[string][]candidate),
+	}
+	for _, pdef := range env.Packages {
+		if _, ok := r.declared[pdef.Name]; !ok {
+			r.declared[pdef.Name] = pdef
+		}
+	}
+	return r
+}
+
+func (r *resolver) provided(name string) bool {
+	for _, pv := range r.env.Provided {
+		if pv == name {
+			return true
+		}
+	}
+	return false
+}
+
+// repoCandidates lists the versions of a package in a repository,
+// newest first.
+func (r *resolver) repoCandidates(rname string, pname string) []candidate {
+	cands := make([]candidate, 0)
+	for _, p := range r.env.Repositories[rname].Packages {
+		if p.Name == pname {
+			cands = append(cands, candidate{Repo: rname, Pkg: p})
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return CompareVersions(cands[i].Pkg.Version, cands[j].Pkg.Version) > 0
+	})
+	return cands
+}
+
+func (r *resolver) candidatesFor(ctx context.Context, name string) ([]candidate, error) {
+
+	if cands, ok := r.candidates[name]; ok {
+		return cands, nil
+	}
+
+	pdef, declared := r.declared[name]
+	var pkg Package
+	var err error
+	cands := make([]candidate, 0)
+	switch {
+	case declared && len(pdef.Path) > 0:
+		pkg, err = LocalPackage(pdef.Name, pdef.Path)
+		cands = append(cands, candidate{Repo: "path", Pkg: pkg, Pinned: true})
+	case declared && len(pdef.Git) > 0:
+		pkg, err = r.env.GitPackageContext(ctx, pdef)
+		cands = append(cands, candidate{Repo: "git", Pkg: pkg, Pinned: true})
+	case declared && pdef.Recipe != nil:
+		pkg, err = r.env.RecipePackageContext(ctx, pdef)
+		cands = append(cands, candidate{Repo: "recipe", Pkg: pkg, Pinned: true})
+	case declared && len(pdef.Repo) > 0:
+		if _, ok := r.env.Repositories[pdef.Repo]; !ok {
+			return nil, RepositoryNotFoundError(pdef.Repo)
+		}
+		cands = r.repoCandidates(pdef.Repo, name)
+		if len(cands) == 0 {
+			return nil, PackageNotFoundError(name, pdef.Repo)
+		}
+	default:
+		for _, rname := range r.env.Prefer {
+			cands = append(cands, r.repoCandidates(rname, name)...)
+		}
+		if len(cands) == 0 {
+			return nil, NoSuchPackageError(name)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.candidates[name] = cands
+	return cands, nil
+}
+
+// allows tells whether a candidate satisfies requirements. Pinned
+// candidates only answer to the Emenv file.
+func allows(c candidate, reqs []Requirement) bool {
+	for _, req := range reqs {
+		if c.Pinned && len(req.By) > 0 {
+			continue
+		}
+		for _, constraint := range req.Constraints {
+			if !constraint.Allows(c.Pkg.Version) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// conflict reports that no candidate for name satisfies reqs, listing
+// the repositories each available version comes from.
+func (r *resolver) conflict(name string, reqs []Requirement) error {
+	versions := make([]string, 0)
+	repos := make(map[string][]string)
+	for _, c := range r.candidates[name] {
+		v := c.Pkg.Version.Literal
+		if _, ok := repos[v]; !ok {
+			versions = append(versions, v)
+		}
+		repos[v] = append(repos[v], c.Repo)
+	}
+	available := make([]string, 0)
+	for _, v := range versions {
+		available = append(available, fmt.Sprintf("%s from %s", v, strings.Join(repos[v], ", ")))
+	}
+	return &ResolutionConflict{Name: name, Requirements: reqs, Available: available}
+}
+
+// fail records the first conflict met and returns err.
+func (r *resolver) fail(err error) error {
+	if r.failure == nil {
+		r.failure = err
+	}
+	return err
+}
+
+// recoverable tells whether a failure may be avoided by choosing
+// other versions.
+func recoverable(err error) bool {
+	var conflict *ResolutionConflict
+	var notFound *PackageNotFound
+	var noRepo *RepositoryNotFound
+	return errors.As(err, &conflict) || errors.As(err, &notFound) || errors.As(err, &noRepo)
+}
+
+// require adds a requirement to s, failing when it rules out the
+// version already selected.
+func (r *resolver) require(s *resolveState, req Requirement) error {
+	s.required[req.Name] = append(s.required[req.Name], req)
+	if r.provided(req.Name) {
+		return nil
+	}
+	if c, ok := s.selected[req.Name]; ok {
+		if !allows(c, []Requirement{req}) {
+			return r.conflict(req.Name, s.required[req.Name])
+		}
+		return nil
+	}
+	for _, name := range s.queue {
+		if name == req.Name {
+			return nil
+		}
+	}
+	s.queue = append(s.queue, req.Name)
+	return nil
+}
+
+func (r *resolver) solve(ctx context.Context, s *resolveState) (*resolveState, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	name := ""
+	for _, n := range s.queue {
+		if _, ok := s.selected[n]; !ok {
+			name = n
+			break
+		}
+	}
+	if name == "" {
+		return s, nil
+	}
+
+	cands, err := r.candidatesFor(ctx, name)
+	if err != nil {
+		if reqs := s.required[name]; len(reqs) > 0 && len(reqs[0].By) > 0 {
+			err = fmt.Errorf("%s requires %s: %w", reqs[0].Who(), name, err)
+		}
+		if recoverable(err) {
+			return nil, r.fail(err)
+		}
+		return nil, err
+	}
+
+	for _, c := range cands {
+		if !allows(c, s.required[name]) {
+			continue
+		}
+		if r.steps++; r.steps > maxResolveSteps {
+			return nil, &ResolutionAborted{Steps: maxResolveSteps}
+		}
+		next := s.clone()
+		next.selected[name] = c
+		var err error
+		for _, dep := range c.Pkg.Dependencies {
+			err = r.require(next, Requirement{
+				Name:        dep.Name,
+				By:          c.Pkg.Name,
+				ByVersion:   c.Pkg.Version.Literal,
+				Constraints: MinimumVersion(dep.Version),
+			})
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			r.fail(err)
+			continue
+		}
+		solution, err := r.solve(ctx, next)
+		if err == nil {
+			return solution, nil
+		}
+		if !recoverable(err) {
+			return nil, err
+		}
+	}
+	return nil, r.fail(r.conflict(name, s.required[name]))
+}
+
+// build fills the install set from a solution. Each package appears
+// in full at the shallowest depth it is required at, and as a shadow
+// everywhere else.
+func (r *resolver) build(s *resolveState) {
+
+	set := &r.env.InstallSet
+	depth := make(map[string]int)
+	level := make([]string, 0)
+	for _, pdef := range r.env.Packages {
+		if _, ok := depth[pdef.Name]; !ok {
+			depth[pdef.Name] = 0
+			level = append(level, pdef.Name)
+		}
+	}
+	for d := 1; len(level) > 0; d++ {
+		next := make([]string, 0)
+		for _, name := range level {
+			for _, dep := range s.selected[name].Pkg.Dependencies {
+				if _, ok := depth[dep.Name]; !ok {
+					depth[dep.Name] = d
+					next = append(next, dep.Name)
+				}
+			}
+		}
+		level = next
+	}
+
+	placed := make(map[string]bool)
+	var place func(parent *InstallNode, name string, d int, ptype PackageType)
+	place = func(parent *InstallNode, name string, d int, ptype PackageType) {
+		if placed[name] || depth[name] != d {
+			idef := InstallDef{Name: name, Type: ShadowPackage}
+			parent.Children = append(parent.Children, InstallNode{Def: idef})
+			return
+		}
+		placed[name] = true
+
+		if r.provided(name) {
+			idef := InstallDef{Name: name, Type: ProvidedPackage, Depth: 0}
+			set.Packages[name] = idef
+			parent.Children = append(parent.Children, InstallNode{Def: idef})
+			return
+		}
+
+		c := s.selected[name]
+		idef := InstallDef{
+			Name:      name,
+			Repo:      c.Repo,
+			StoreType: c.Pkg.Type,
+			Type:      ptype,
+			Depth:     d,
+			URL:       c.Pkg.URL,
+			Version:   c.Pkg.Version.Literal,
+		}
+		if c.Pkg.Type == LinkStorage {
+			idef.Path = c.Pkg.URL
+		}
+		if len(c.Pkg.Commit) > 0 {
+			idef.Commit = c.Pkg.Commit
+		}
+		if c.Pkg.Type == GitStorage {
+			idef.Ref = r.declared[name].Ref
+		}
+		inode := InstallNode{Def: idef, Children: make([]InstallNode, 0)}
+		for _, dep := range c.Pkg.Dependencies {
+			place(&inode, dep.Name, d+1, DependencyPackage)
+		}
+		parent.Children = append(parent.Children, inode)
+		set.Packages[name] = idef
+		set.Resolved[name] = c.Pkg
+	}
+	for _, pdef := range r.env.Packages {
+		place(&set.Tree, pdef.Name, 0, pdef.Type)
+	}
+}
@@ -0,0 +1,192 @@
+package emenv
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pinnedTime is when the commit of the pinned package is made, which
+// its recipe snapshot is versioned after.
+var pinnedTime = time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)
+
+// pinnedCheckout makes a git checkout of package b at version 1.0.
+func pinnedCheckout(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	body := ";;; b.el --- b\n;; Version: 1.0\n;;; b.el ends here\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.el"), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stamp := pinnedTime.Format(time.RFC3339)
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "b.el"},
+		{"-c", "user.name=emenv", "-c", "user.email=emenv@example.com", "commit", "--quiet", "-m", "b"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+stamp, "GIT_COMMITTER_DATE="+stamp)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+	return dir
+}
+
+// manyVersions is an archive of six packages with eight versions each.
+func manyVersions() string {
+	entries := make([]string, 0)
+	for p := 1; p <= 6; p++ {
+		for v := 1; v <= 8; v++ {
+			entries = append(entries, fmt.Sprintf(`(a%d . [(%d) nil "x" single])`, p, v))
+		}
+	}
+	return "(1 " + strings.Join(entries, "\n ") + `
+ (z . [(1) nil "x" single]))`
+}
+
+// TestResolve resolves Emenv files against archives served by a
+// MemoryFetcher. Archives are given by source name, and want lists
+// the version and origin picked for each package, or err the message
+// of the failure, {config} standing for the path of the Emenv file.
+func TestResolve(t *testing.T) {
+
+	checkout := pinnedCheckout(t)
+	snapshot := SnapshotVersion(pinnedTime).Literal
+
+	// a 2 needs b 2 while the pinned b is 1.0
+	abArchive := `(1
+ (a . [(2) ((b (2))) "a" single])
+ (a . [(1) ((b (1))) "a" single])
+ (b . [(2) nil "b" single])
+ (b . [(1) nil "b" single]))`
+
+	cases := []struct {
+		name     string
+		config   string
+		archives map[string]string
+		want     map[string]string
+		err      string
+	}{
+		{
+			name:     "newest",
+			config:   "(source fake \"https://fake.example/elpa\")\n(prefer fake)\n(package a)\n",
+			archives: map[string]string{"fake": abArchive},
+			want:     map[string]string{"a": "2 fake", "b": "2 fake"},
+		},
+		{
+			name:   "older version",
+			config: "(source fake \"https://fake.example/elpa\")\n(prefer fake)\n(package a)\n",
+			archives: map[string]string{"fake": `(1
+ (a . [(2) ((b (2))) "a" single])
+ (a . [(1) ((b (1))) "a" single])
+ (b . [(1) nil "b" single]))`},
+			want: map[string]string{"a": "1 fake", "b": "1 fake"},
+		},
+		{
+			name:     "bounded by the Emenv file",
+			config:   "(source fake \"https://fake.example/elpa\")\n(prefer fake)\n(package a)\n(package b (version \"< 2\"))\n",
+			archives: map[string]string{"fake": abArchive},
+			want:     map[string]string{"a": "1 fake", "b": "1 fake"},
+		},
+		{
+			name: "conflict",
+			config: `(source old "https://old.example/elpa")
+(prefer old melpa-stable melpa)
+(package ag)
+(package dash (version "< 2"))
+`,
+			archives: map[string]string{
+				"old":          `(1 (dash . [(1 5) nil "lists" single]))`,
+				"melpa-stable": `(1 (dash . [(2 19 1) nil "lists" single]) (ag . [(0 48) ((dash (2 8 0))) "search" single]))`,
+				"melpa":        `(1 (dash . [(2 19 1) nil "lists" single]))`,
+			},
+			err: `No version of dash satisfies all requirements:
+  Emenv ({config}:4:10) requires dash < 2
+  ag 0.48 requires dash >= 2.8.0
+  available: 1.5 from old; 2.19.1 from melpa-stable, melpa`,
+		},
+		{
+			name:     "pinned path",
+			config:   fmt.Sprintf("(source fake \"https://fake.example/elpa\")\n(prefer fake)\n(package a)\n(package b (path %q))\n", checkout),
+			archives: map[string]string{"fake": abArchive},
+			want:     map[string]string{"a": "2 fake", "b": "1.0 path"},
+		},
+		{
+			name:     "pinned git",
+			config:   fmt.Sprintf("(source fake \"https://fake.example/elpa\")\n(prefer fake)\n(package a)\n(package b (git %q))\n", checkout),
+			archives: map[string]string{"fake": abArchive},
+			want:     map[string]string{"a": "2 fake", "b": "1.0 git"},
+		},
+		{
+			name:     "pinned recipe",
+			config:   fmt.Sprintf("(source fake \"https://fake.example/elpa\")\n(prefer fake)\n(package a)\n(recipe b :fetcher git :url %q)\n", checkout),
+			archives: map[string]string{"fake": abArchive},
+			want:     map[string]string{"a": "2 fake", "b": snapshot + " recipe"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			env, mem := memoryEnv(t, dir, tc.config)
+			for name, archive := range tc.archives {
+				mem.Files[env.Sources[name].URL+"/archive-contents"] = []byte(archive)
+			}
+			if err := env.LoadRepositories(); err != nil {
+				t.Fatal(err)
+			}
+
+			err := env.ResolveInstallSet()
+			if len(tc.err) > 0 {
+				want := strings.Replace(tc.err, "{config}", filepath.Join(dir, ConfigName), 1)
+				if err == nil || err.Error() != want {
+					t.Fatalf("got error %v, want:\n%s", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tc.want {
+				idef := env.InstallSet.Packages[name]
+				if got := idef.Version + " " + idef.Repo; got != want {
+					t.Errorf("%s resolved to %s, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestResolveAborted gives up on archives whose versions would take
+// too long to go through: z is only rejected once every combination
+// of the other packages was tried.
+func TestResolveAborted(t *testing.T) {
+
+	config := "(source fake \"https://fake.example/elpa\")\n(prefer fake)\n"
+	for p := 1; p <= 6; p++ {
+		config += fmt.Sprintf("(package a%d)\n", p)
+	}
+	config += "(package z (version \"< 1\"))\n"
+
+	env, mem := memoryEnv(t, t.TempDir(), config)
+	mem.Files["https://fake.example/elpa/archive-contents"] = []byte(manyVersions())
+	if err := env.LoadRepositories(); err != nil {
+		t.Fatal(err)
+	}
+
+	var aborted *ResolutionAborted
+	if err := env.ResolveInstallSet(); !errors.As(err, &aborted) {
+		t.Fatalf("got error %v, want a *ResolutionAborted", err)
+	}
+}
@@ -0,0 +1,142 @@
+package emenv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultServeAddr is where emenv serve listens unless told otherwise.
+const DefaultServeAddr = ":8080"
+
+// ServeHandler exposes every source of the environment as an ELPA
+// archive: /<source>/archive-contents is the synced archive, and the
+// packages it lists are served from the download cache. Sources
+// requiring authentication are left out unless Options.ServePrivate
+// is set, as the server asks for none.
+func (env *Env) ServeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "":
+			env.serveIndex(w)
+		case len(parts) == 2 && parts[1] != "" && parts[1] != "." && parts[1] != "..":
+			src, ok := env.Sources[parts[0]]
+			if !ok || !env.servable(src) {
+				http.NotFound(w, r)
+				return
+			}
+			body, modified, ok := env.serveFile(src, parts[1])
+			if !ok {
+				env.notify(RequestServed{Path: r.URL.Path, Found: false})
+				http.NotFound(w, r)
+				return
+			}
+			env.notify(RequestServed{Path: r.URL.Path, Found: true})
+			http.ServeContent(w, r, parts[1], modified, bytes.NewReader(body))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (env *Env) serveIndex(w http.ResponseWriter) {
+
+	names := make([]string, 0)
+	for name, src := range env.Sources {
+		if env.servable(src) && FileExists(filepath.Join(env.ArchiveDir, name)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s/\n", name)
+	}
+}
+
+func (env *Env) servable(src Source) bool {
+	return src.Auth == nil || env.Options.ServePrivate
+}
+
+// serveFile looks up a file of a source, first among synced archives,
+// then in the cache, then on disk for sources living there.
+func (env *Env) serveFile(src Source, file string) ([]byte, time.Time, bool) {
+
+	if file == "archive-contents" {
+		path := filepath.Join(env.ArchiveDir, src.Name)
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, time.Time{}, false
+		}
+		return body, modTime(path), true
+	}
+
+	url := fmt.Sprintf("%s/%s", src.URL, file)
+	if body, ok := env.Cache.Get(url); ok {
+		return body, time.Time{}, true
+	}
+	if path, local := LocalPath(url); local {
+		if body, err := ioutil.ReadFile(path); err == nil {
+			return body, modTime(path), true
+		}
+	}
+	return nil, time.Time{}, false
+}
+
+// Serve runs an ELPA mirror of the environment's sources on addr
+// until it fails.
+func (env *Env) Serve(addr string) error {
+	return env.ServeContext(context.Background(), addr)
+}
+
+// ServeContext serves until ctx is done, then lets the requests in
+// flight complete before returning.
+func (env *Env) ServeContext(ctx context.Context, addr string) error {
+
+	server := &http.Server{Addr: addr, Handler: env.ServeHandler()}
+	done := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			done <- server.Shutdown(shutdown)
+		case <-stop:
+		}
+	}()
+
+	sources := 0
+	for _, src := range env.Sources {
+		if env.servable(src) {
+			sources++
+		}
+	}
+	env.notify(ServeStarted{Addr: addr, Sources: sources})
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+func modTime(path string) time.Time {
+	st, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
@@ -0,0 +1,216 @@
+package emenv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultWidth is the column at which PrettyPrintNode starts
+// breaking lists over several lines.
+const DefaultWidth = 72
+
+func NewSymbol(s string) Node {
+	return Node{Type: SymbolNode, String: s}
+}
+
+func NewKeyword(s string) Node {
+	return Node{Type: KeywordNode, String: s}
+}
+
+func NewString(s string) Node {
+	return Node{Type: StringNode, String: s}
+}
+
+func NewNumber(n int) Node {
+	return Node{Type: NumberNode, Number: n}
+}
+
+func NewList(children ...Node) Node {
+	return Node{Type: ListNode, Children: children}
+}
+
+func NewVector(children ...Node) Node {
+	return Node{Type: VectorNode, Children: children}
+}
+
+func NewDot() Node {
+	return Node{Type: DotNode}
+}
+
+func NewQuote(node Node) Node {
+	return Node{Type: QuoteNode, Children: []Node{node}}
+}
+
+// unquote strips the quotes from node and its children. The Emenv file
+// has no use for them, but tolerates them as emacs-lisp habits have
+// people write (package 'foo).
+func unquote(node Node) Node {
+
+	if node.Type == QuoteNode {
+		inner := unquote(node.Children[0])
+		inner.Pos = node.Pos
+		return inner
+	}
+	if len(node.Children) == 0 {
+		return node
+	}
+	children := make([]Node, len(node.Children))
+	for i, child := range node.Children {
+		children[i] = unquote(child)
+	}
+	node.Children = children
+	return node
+}
+
+func EscapeString(s string) string {
+	buf := bytes.NewBufferString("\"")
+	for _, r := range s {
+		if r == '"' || r == '\\' {
+			buf.WriteRune('\\')
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteRune('"')
+	return buf.String()
+}
+
+func isAtomDelimiter(r rune, first bool) bool {
+	switch r {
+	case '(', ')', '[', ']', '.', '"', '\'', ';', '\\', '`', ',':
+		return true
+	case '#', '?':
+		return first
+	}
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func escapeAtom(s string) string {
+	buf := bytes.NewBufferString("")
+	for i, r := range s {
+		if isAtomDelimiter(r, i == 0) {
+			buf.WriteRune('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// EscapeSymbol renders a symbol name so that reading it back yields
+// the same symbol, escaping delimiters and any name which would
+// otherwise be read as a number, a keyword or nil.
+func EscapeSymbol(s string) string {
+	if s == "" {
+		return "##"
+	}
+	out := escapeAtom(s)
+	if _, err := strconv.Atoi(s); err == nil || s == "nil" || strings.HasPrefix(s, ":") {
+		return "\\" + out
+	}
+	return out
+}
+
+func writeNode(buf *bytes.Buffer, node Node) {
+	switch {
+	case node.Type == StringNode:
+		buf.WriteString(EscapeString(node.String))
+	case node.Type == SymbolNode:
+		buf.WriteString(EscapeSymbol(node.String))
+	case node.Type == KeywordNode:
+		buf.WriteString(":" + escapeAtom(node.String))
+	case node.Type == NumberNode:
+		buf.WriteString(strconv.Itoa(node.Number))
+	case node.Type == NilNode:
+		buf.WriteString("nil")
+	case node.Type == DotNode:
+		buf.WriteString(".")
+	case node.Type == QuoteNode:
+		buf.WriteString("'")
+		writeNode(buf, node.Children[0])
+	case node.Type == PairNode:
+		buf.WriteString("(")
+		writeNode(buf, node.Children[0])
+		buf.WriteString(" . ")
+		writeNode(buf, node.Children[1])
+		buf.WriteString(")")
+	case node.Type == ListNode || node.Type == VectorNode:
+		open, close := delimiters(node)
+		buf.WriteString(open)
+		for i, child := range node.Children {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			writeNode(buf, child)
+		}
+		buf.WriteString(close)
+	}
+}
+
+func delimiters(node Node) (string, string) {
+	if node.Type == VectorNode {
+		return "[", "]"
+	}
+	return "(", ")"
+}
+
+// PrintNode renders a node on a single line. It is the inverse
+// of ParseTree: reading the output back yields an identical tree.
+func PrintNode(node Node) string {
+	buf := bytes.NewBufferString("")
+	writeNode(buf, node)
+	return buf.String()
+}
+
+func prettyNode(buf *bytes.Buffer, node Node, indent int, width int) {
+	flat := PrintNode(node)
+	if indent+len(flat) <= width ||
+		(node.Type != ListNode && node.Type != VectorNode) ||
+		len(node.Children) < 2 {
+		buf.WriteString(flat)
+		return
+	}
+	open, close := delimiters(node)
+	buf.WriteString(open)
+	children := node.Children
+	step := 1
+	if node.Type == ListNode && children[0].Type == SymbolNode {
+		// Forms are laid out as code: the head and its first
+		// argument share a line, the rest is indented as a body
+		head := PrintNode(children[0]) + " "
+		buf.WriteString(head)
+		prettyNode(buf, children[1], indent+1+len(head), width)
+		children = children[2:]
+		step = 2
+	} else {
+		prettyNode(buf, children[0], indent+1, width)
+		children = children[1:]
+	}
+	for _, child := range children {
+		buf.WriteString("\n")
+		buf.WriteString(strings.Repeat(" ", indent+step))
+		prettyNode(buf, child, indent+step, width)
+	}
+	buf.WriteString(close)
+}
+
+// PrettyPrintNode renders a node, breaking lists which do not fit
+// within width columns so that each child sits on its own line.
+func PrettyPrintNode(node Node, width int) string {
+	buf := bytes.NewBufferString("")
+	prettyNode(buf, node, 0, width)
+	return buf.String()
+}
+
+// WriteForms writes a file made of a leading comment and a sequence
+// of pretty-printed top-level forms.
+func WriteForms(path string, comment string, forms []Node) error {
+	buf := bytes.NewBufferString(fmt.Sprintf(";; %s\n", comment))
+	for _, form := range forms {
+		buf.WriteString(PrettyPrintNode(form, DefaultWidth))
+		buf.WriteString("\n")
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
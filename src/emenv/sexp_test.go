@@ -0,0 +1,148 @@
+package emenv
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// readBack parses the output of PrintNode.
+func readBack(t *testing.T, printed string) Node {
+	t.Helper()
+	tokens, err := ParseTokens([]byte(printed))
+	if err != nil {
+		t.Fatalf("tokenizing %s: %s", printed, err)
+	}
+	node, err := ParseTree(tokens)
+	if err != nil {
+		t.Fatalf("parsing %s: %s", printed, err)
+	}
+	return node
+}
+
+// sameTree compares nodes, ignoring their positions.
+func sameTree(a, b Node) bool {
+	if a.Type != b.Type || a.String != b.String || a.Number != b.Number ||
+		len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.Children {
+		if !sameTree(a.Children[i], b.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPrintNodeRoundTrip(t *testing.T) {
+	cases := []Node{
+		NewString(`say "hi"`),
+		NewString(`C:\path\to\dir`),
+		NewString("\"\\\""),
+		NewString(""),
+		NewString("two\nlines"),
+		NewSymbol(""),
+		NewSymbol("foo-bar"),
+		NewSymbol("with space"),
+		NewSymbol("a(b)c"),
+		NewSymbol("1"),
+		NewSymbol("nil"),
+		NewSymbol(":not-a-keyword"),
+		NewSymbol("#hash"),
+		NewSymbol("?mark"),
+		NewSymbol("quote'd"),
+		NewKeyword("url"),
+		NewKeyword("files"),
+		NewNumber(0),
+		NewNumber(42),
+		{Type: NilNode},
+		NewList(),
+		NewList(NewSymbol("a"), NewDot(), NewSymbol("b")),
+		NewList(NewSymbol(":url"), NewDot(), NewString("https://example.com/a b")),
+		NewVector(NewList(NewNumber(2), NewNumber(19)), Node{Type: NilNode}, NewString("x"), NewSymbol("single")),
+		NewVector(),
+		NewQuote(NewSymbol("x")),
+		NewQuote(NewList(NewSymbol("a"), NewQuote(NewSymbol("b")))),
+		NewList(NewSymbol("add-to-list"), NewQuote(NewSymbol("load-path")), NewString(`/tmp/it's "here"\`)),
+	}
+	for _, node := range cases {
+		printed := PrintNode(node)
+		if back := readBack(t, printed); !sameTree(node, back) {
+			t.Errorf("%s read back as %s", printed, PrintNode(back))
+		}
+	}
+}
+
+func TestQuoteReadsAsQuoteNode(t *testing.T) {
+	node := readBack(t, "'x")
+	if node.Type != QuoteNode || len(node.Children) != 1 ||
+		node.Children[0].Type != SymbolNode || node.Children[0].String != "x" {
+		t.Fatalf("'x read as %#v", node)
+	}
+	node = readBack(t, "(a 'b)")
+	if node.Type != ListNode || len(node.Children) != 2 || node.Children[1].Type != QuoteNode {
+		t.Fatalf("(a 'b) read as %#v", node)
+	}
+}
+
+// Trees are made of atoms drawn from characters the printer has to
+// escape, so that random trees exercise every quoting rule.
+const atomChars = "ab1-_+.:#?\\\"'()[];` ,\n"
+
+func randomAtom(rng *rand.Rand) string {
+	s := make([]byte, rng.Intn(5))
+	for i := range s {
+		s[i] = atomChars[rng.Intn(len(atomChars))]
+	}
+	return string(s)
+}
+
+func randomNode(rng *rand.Rand, depth int) Node {
+	kinds := 7
+	if depth == 0 {
+		kinds = 4
+	}
+	switch rng.Intn(kinds) {
+	case 0:
+		return NewString(randomAtom(rng))
+	case 1:
+		return NewSymbol(randomAtom(rng))
+	case 2:
+		return NewNumber(rng.Intn(1000))
+	case 3:
+		if name := randomAtom(rng); len(name) > 0 {
+			return NewKeyword(name)
+		}
+		return Node{Type: NilNode}
+	case 4:
+		return NewQuote(randomNode(rng, depth-1))
+	case 5:
+		if rng.Intn(3) == 0 {
+			return NewList(randomNode(rng, depth-1), NewDot(), randomNode(rng, depth-1))
+		}
+		fallthrough
+	default:
+		children := make([]Node, rng.Intn(4))
+		for i := range children {
+			children[i] = randomNode(rng, depth-1)
+		}
+		if rng.Intn(2) == 0 {
+			return NewVector(children...)
+		}
+		return NewList(children...)
+	}
+}
+
+func TestPrintNodeRoundTripRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		node := randomNode(rng, 4)
+		printed := PrintNode(node)
+		if back := readBack(t, printed); !sameTree(node, back) {
+			t.Fatalf("%s read back as %s", printed, PrintNode(back))
+		}
+		pretty := PrettyPrintNode(node, 20)
+		if back := readBack(t, pretty); !sameTree(node, back) {
+			t.Fatalf("%s read back as %s", pretty, PrintNode(back))
+		}
+	}
+}
@@ -3,31 +3,86 @@ package emenv
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-func (env *Env) AddPackageToConfig(list []Node, ptype PackageType) error {
-
-	if list[0].Type != SymbolNode && list[0].Type != StringNode {
-		return BadSyntaxError
+// PackageOptions lists the options accepted by package and theme
+// directives, from and repo being synonyms.
+func PackageOptions(pdef *PackageDef) []Option {
+	repo := func(args []Node) error {
+		name, err := NameArg(args[0])
+		if err != nil {
+			return err
+		}
+		pdef.Repo = name
+		return nil
 	}
-	pdef := PackageDef{Name: list[0].String, Type: ptype}
-
-	if len(list) > 1 {
-		for _, elem := range list[1:] {
-			if elem.Type != ListNode || elem.Children[0].Type != SymbolNode {
-				return BadSyntaxError
+	path := func(args []Node) error {
+		dir, err := StringArg(args[0])
+		if err != nil {
+			return err
+		}
+		pdef.Path, err = ResolvePath(args[0].Pos, dir)
+		return err
+	}
+	git := func(args []Node) error {
+		url, err := StringArg(args[0])
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(url, "://") {
+			if url, err = ResolvePath(args[0].Pos, url); err != nil {
+				return err
 			}
-			arg := elem.Children[0].String
-			switch {
-			case arg == "repo":
-				if len(elem.Children) != 2 && elem.Children[1].Type != SymbolNode {
-					return BadSyntaxError
-				}
-				pdef.Repo = elem.Children[1].String
-			default:
-				return UnknownDirectiveError
+		}
+		pdef.Git = url
+		return ParseOptions("git", args[1:], []Option{
+			{Name: "ref", MinArgs: 1, MaxArgs: 1, Apply: func(args []Node) error {
+				pdef.Ref, err = NameArg(args[0])
+				return err
+			}},
+		})
+	}
+	version := func(args []Node) error {
+		for _, arg := range args {
+			s, err := StringArg(arg)
+			if err != nil {
+				return err
+			}
+			c, err := ParseVersionConstraint(s)
+			if err != nil {
+				return &OptionError{Pos: arg.Pos, Reason: err.Error()}
 			}
+			pdef.Constraints = append(pdef.Constraints, c)
 		}
+		return nil
+	}
+	return []Option{
+		{Name: "from", MinArgs: 1, MaxArgs: 1, Apply: repo},
+		{Name: "git", MinArgs: 1, MaxArgs: -1, Apply: git},
+		{Name: "repo", MinArgs: 1, MaxArgs: 1, Apply: repo},
+		{Name: "path", MinArgs: 1, MaxArgs: 1, Apply: path},
+		{Name: "version", MinArgs: 1, MaxArgs: -1, Apply: version},
+	}
+}
+
+func (env *Env) AddPackageToConfig(directive Node, list []Node, ptype PackageType) error {
+
+	if len(list) == 0 {
+		return &OptionError{Pos: directive.Pos, Directive: directive.String,
+			Reason: "missing package name"}
+	}
+	if list[0].Type != SymbolNode && list[0].Type != StringNode {
+		return &OptionError{Pos: list[0].Pos, Directive: directive.String,
+			Reason: fmt.Sprintf("package name must be a symbol or string, got %s", PrintNode(list[0]))}
+	}
+	pdef := PackageDef{Name: list[0].String, Type: ptype, Pos: list[0].Pos}
+
+	if err := ParseOptions(directive.String, list[1:], PackageOptions(&pdef)); err != nil {
+		return err
 	}
 	env.Packages = append(env.Packages, pdef)
 	return nil
@@ -35,10 +90,53 @@ func (env *Env) AddPackageToConfig(list []Node, ptype PackageType) error {
 
 func (env *Env) AddSourceToConfig(list []Node) error {
 
-	if len(list) != 2 || list[0].Type != SymbolNode || list[1].Type != StringNode {
-		return BadSyntaxError
+	if len(list) < 2 || list[0].Type != SymbolNode || list[1].Type != StringNode {
+		return BadSyntaxAt(posOf(list))
+	}
+	sdef := Source{Name: list[0].String, URL: list[1].String, Pos: list[0].Pos}
+	if !strings.Contains(sdef.URL, "://") {
+		path, err := ResolvePath(list[1].Pos, sdef.URL)
+		if err != nil {
+			return err
+		}
+		sdef.URL = path
+	}
+	// Like mirrors, URLs are kept without a trailing slash, so that
+	// files are found under URL + "/"
+	sdef.URL = strings.TrimSuffix(sdef.URL, "/")
+	auth := SourceAuth{}
+	err := ParseOptions("source", list[2:], []Option{
+		AuthOption(&auth),
+		{Name: "mirror", MinArgs: 1, MaxArgs: -1, Apply: func(args []Node) error {
+			for _, arg := range args {
+				url, err := StringArg(arg)
+				if err != nil {
+					return err
+				}
+				if !strings.Contains(url, "://") {
+					if url, err = ResolvePath(arg.Pos, url); err != nil {
+						return err
+					}
+				}
+				sdef.Mirrors = append(sdef.Mirrors, strings.TrimSuffix(url, "/"))
+			}
+			return nil
+		}},
+		{Name: "timeout", MinArgs: 1, MaxArgs: 1, Apply: func(args []Node) error {
+			if args[0].Type != NumberNode || args[0].Number <= 0 {
+				return &OptionError{Pos: args[0].Pos,
+					Reason: fmt.Sprintf("expected a number of seconds, got %s", PrintNode(args[0]))}
+			}
+			sdef.Timeout = time.Duration(args[0].Number) * time.Second
+			return nil
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if auth != (SourceAuth{}) {
+		sdef.Auth = &auth
 	}
-	sdef := Source{Name: list[0].String, URL: list[1].String}
 	env.Sources[list[0].String] = sdef
 	return nil
 }
@@ -49,7 +147,7 @@ func (env *Env) SetPreferenceOrder(list []Node) error {
 
 	for _, elem := range list {
 		if elem.Type != SymbolNode && elem.Type != StringNode {
-			return BadSyntaxError
+			return BadSyntaxAt(elem.Pos)
 		}
 		prefer = append(prefer, elem.String)
 	}
@@ -62,7 +160,7 @@ func (env *Env) SetProvidedDependencies(list []Node) error {
 	provided := make([]string, 0)
 	for _, elem := range list {
 		if elem.Type != SymbolNode && elem.Type != StringNode {
-			return BadSyntaxError
+			return BadSyntaxAt(elem.Pos)
 		}
 		provided = append(provided, elem.String)
 	}
@@ -70,25 +168,145 @@ func (env *Env) SetProvidedDependencies(list []Node) error {
 	return nil
 }
 
+// ConfigPath reads the single path argument of a directive. Relative
+// paths are taken from the directory of the file holding the
+// directive.
+func ConfigPath(directive Node, list []Node) (string, error) {
+
+	if len(list) != 1 || list[0].Type != StringNode {
+		return "", &OptionError{Pos: directive.Pos, Directive: directive.String,
+			Reason: "expects a single path string"}
+	}
+	return ResolvePath(list[0].Pos, list[0].String)
+}
+
+// ResolvePath expands environment variables and ~ in a path found in
+// a configuration file at pos, making it absolute relative to that
+// file.
+func ResolvePath(pos Position, path string) (string, error) {
+	path = os.ExpandEnv(path)
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	if !filepath.IsAbs(path) {
+		dir, err := filepath.Abs(filepath.Dir(pos.File))
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, path)
+	}
+	return path, nil
+}
+
+func (env *Env) IncludeConfig(directive Node, list []Node) error {
+	path, err := ConfigPath(directive, list)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, loading := range env.Loading {
+		if loading == abs {
+			chain := append(append([]string(nil), env.Loading[i:]...), abs)
+			return IncludeCycleError(directive.Pos, chain)
+		}
+	}
+	return env.LoadConfig(path)
+}
+
+// SetOffline handles (offline), (offline t) and (offline nil). The
+// command line may enable offline mode but never disable it.
+func (env *Env) SetOffline(directive Node, list []Node) error {
+	switch {
+	case len(list) == 0:
+		env.Options.Offline = true
+	case len(list) == 1 && list[0].Type == NilNode:
+	case len(list) == 1 && list[0].Type == SymbolNode && list[0].String == "t":
+		env.Options.Offline = true
+	default:
+		return &OptionError{Pos: directive.Pos, Directive: directive.String,
+			Reason: "expects t or nil"}
+	}
+	return nil
+}
+
+func (env *Env) SetInstallDir(directive Node, list []Node) error {
+	path, err := ConfigPath(directive, list)
+	if err != nil {
+		return err
+	}
+	env.BaseDir = path
+	return nil
+}
+
+// AddProfileToConfig applies the directives of a profile block when
+// the profile has been selected, and ignores them otherwise.
+func (env *Env) AddProfileToConfig(directive Node, list []Node) error {
+
+	if len(list) == 0 {
+		return &OptionError{Pos: directive.Pos, Directive: directive.String,
+			Reason: "missing profile name"}
+	}
+	name, err := NameArg(list[0])
+	if err != nil {
+		return err
+	}
+
+	selected := false
+	for _, p := range env.Options.Profiles {
+		if p == name {
+			selected = true
+		}
+	}
+	if !selected {
+		return nil
+	}
+
+	for _, form := range list[1:] {
+		if form.Type != ListNode || len(form.Children) == 0 {
+			return &OptionError{Pos: form.Pos, Directive: directive.String,
+				Reason: fmt.Sprintf("expected a directive, got %s", PrintNode(form))}
+		}
+		if err := env.AddToConfig(form.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (env *Env) AddToConfig(list []Node) error {
 
-	if list[0].Type != SymbolNode {
-		return BadSyntaxError
+	if len(list) == 0 || list[0].Type != SymbolNode {
+		return BadSyntaxAt(posOf(list))
 	}
+	list = unquote(NewList(list...)).Children
 
 	switch {
 	case list[0].String == "package":
-		return env.AddPackageToConfig(list[1:], StandardPackage)
+		return env.AddPackageToConfig(list[0], list[1:], StandardPackage)
+	case list[0].String == "recipe":
+		return env.AddRecipeToConfig(list[0], list[1:])
 	case list[0].String == "theme":
-		return env.AddPackageToConfig(list[1:], ThemePackage)
+		return env.AddPackageToConfig(list[0], list[1:], ThemePackage)
 	case list[0].String == "source":
 		return env.AddSourceToConfig(list[1:])
 	case list[0].String == "prefer":
+		env.PreferPos = list[0].Pos
 		return env.SetPreferenceOrder(list[1:])
 	case list[0].String == "provided":
 		return env.SetProvidedDependencies(list[1:])
+	case list[0].String == "offline":
+		return env.SetOffline(list[0], list[1:])
+	case list[0].String == "install-dir":
+		return env.SetInstallDir(list[0], list[1:])
+	case list[0].String == "include":
+		return env.IncludeConfig(list[0], list[1:])
+	case list[0].String == "profile":
+		return env.AddProfileToConfig(list[0], list[1:])
 	default:
-		return UnknownDirectiveError
+		return &SyntaxError{Pos: list[0].Pos, Err: fmt.Errorf("%w %s", UnknownDirectiveError, list[0].String)}
 	}
 	return UnreachableError
 }
@@ -99,46 +317,84 @@ func FindInSet(pkgs map[string]InstallDef, id InstallDef) (*InstallDef, bool) {
 	if !ok {
 		return nil, false
 	}
-	return &p, (p.Version == id.Version && p.Repo == id.Repo)
+	return &p, (p.Version == id.Version && p.Repo == id.Repo &&
+		p.Path == id.Path && p.Commit == id.Commit)
 }
 
-func (env *Env) LoadPreviousInstallSet() error {
-
-	path := fmt.Sprintf("%s/plist.el", env.BaseDir)
+// ReadPackageList reads the packages recorded in a plist.el file.
+func ReadPackageList(path string) (map[string]InstallDef, error) {
 
 	body, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	tokens, err := ParseTokens(body)
+	tokens, err := ParseFileTokens(path, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tree, err := ParseTree(tokens)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if tree.Type != ListNode {
-		return BadSyntaxError
+		return nil, BadSyntaxAt(tree.Pos)
 	}
+	defs := make(map[string]InstallDef)
 	for _, node := range tree.Children {
-		if node.Type != ListNode || len(node.Children) != 3 {
-			return BadSyntaxError
+		if node.Type != ListNode || len(node.Children) < 3 || len(node.Children)%2 == 0 {
+			return nil, BadSyntaxAt(node.Pos)
 		}
 		if (node.Children[0].Type != SymbolNode ||
 			node.Children[1].Type != StringNode ||
 			node.Children[2].Type != SymbolNode) {
-			return BadSyntaxError
+			return nil, BadSyntaxAt(node.Pos)
 		}
-		env.Previous[node.Children[0].String] = InstallDef{
+		idef := InstallDef{
 			Name: node.Children[0].String,
 			Version: node.Children[1].String,
 			Repo: node.Children[2].String,
 		}
+		// Entries may carry extra properties after the repository
+		props := node.Children[3:]
+		for i := 0; i < len(props); i += 2 {
+			if props[i].Type != KeywordNode || props[i+1].Type != StringNode {
+				return nil, BadSyntaxAt(props[i].Pos)
+			}
+			switch props[i].String {
+			case "path":
+				idef.Path = props[i+1].String
+			case "commit":
+				idef.Commit = props[i+1].String
+			case "url":
+				idef.URL = props[i+1].String
+			case "ref":
+				idef.Ref = props[i+1].String
+			}
+		}
+		defs[idef.Name] = idef
 	}
+	return defs, nil
+}
+
+// loadPreviousPackages reads the package list of the last install, if
+// any, so that git packages stay at the commits it recorded.
+func (env *Env) loadPreviousPackages() {
+	previous, err := ReadPackageList(fmt.Sprintf("%s/plist.el", env.BaseDir))
+	if err == nil {
+		env.Previous = previous
+	}
+}
+
+func (env *Env) LoadPreviousInstallSet() error {
+
+	previous, err := ReadPackageList(fmt.Sprintf("%s/plist.el", env.BaseDir))
+	if err != nil {
+		return err
+	}
+	env.Previous = previous
 
 	// Now that we have a previous installed set, compute differences
 
@@ -163,6 +419,14 @@ func (env *Env) LoadPreviousInstallSet() error {
 			env.DiffSet.Install = append(env.DiffSet.Install, p)
 		}
 	}
-	DumpDiffSet(env.DiffSet)
+	env.notify(DiffComputed{Diff: env.DiffSet})
 	return nil
 }
+
+// posOf is the position of the first of nodes, if any.
+func posOf(nodes []Node) Position {
+	if len(nodes) == 0 {
+		return Position{}
+	}
+	return nodes[0].Pos
+}
@@ -1,6 +1,7 @@
 package emenv
 
 import (
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
@@ -9,7 +10,49 @@ import (
 
 func NewTokenizer(input []byte) Tokenizer {
 	r := strings.NewReader(string(input))
-	return Tokenizer{r: r}
+	return Tokenizer{r: r, pos: Position{Line: 1, Column: 1}}
+}
+
+// NewCommentTokenizer yields a tokenizer which emits comments as
+// CommentToken instead of discarding them, for tools which need to
+// write a file back out.
+func NewCommentTokenizer(input []byte) Tokenizer {
+	tk := NewTokenizer(input)
+	tk.comments = true
+	return tk
+}
+
+func (pos Position) String() string {
+	if pos.File != "" {
+		return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+// ReadRune reads the next rune of the input like the underlying
+// reader does, keeping track of its position.
+func (tk *Tokenizer) ReadRune() (rune, int, error) {
+	r, size, err := tk.r.ReadRune()
+	if err != nil {
+		return 0, 0, err
+	}
+	tk.prev = tk.pos
+	if r == '\n' {
+		tk.pos = Position{File: tk.pos.File, Line: tk.pos.Line + 1, Column: 1}
+	} else {
+		tk.pos.Column++
+	}
+	return r, size, nil
+}
+
+// UnreadRune unreads the last rune read, and moves back to its
+// position.
+func (tk *Tokenizer) UnreadRune() error {
+	if err := tk.r.UnreadRune(); err != nil {
+		return err
+	}
+	tk.pos = tk.prev
+	return nil
 }
 
 func (tk *Tokenizer) SkipComments(top rune) (rune, error) {
@@ -18,7 +61,7 @@ func (tk *Tokenizer) SkipComments(top rune) (rune, error) {
 		return top, nil
 	}
 	for {
-		r, _, err := tk.r.ReadRune()
+		r, _, err := tk.ReadRune()
 		if err != nil {
 			return 0, err
 		}
@@ -37,12 +80,14 @@ func (tk *Tokenizer) SkipComments(top rune) (rune, error) {
 
 func (tk *Tokenizer) NextRune() (rune, error) {
 	for {
-		r, _, err := tk.r.ReadRune()
+		r, _, err := tk.ReadRune()
 		if err != nil {
 			return 0, err
 		}
-		if r, err = tk.SkipComments(r); err != nil {
-			return 0, err
+		if !tk.comments {
+			if r, err = tk.SkipComments(r); err != nil {
+				return 0, err
+			}
 		}
 		if !unicode.IsSpace(r) {
 			return r, nil
@@ -56,6 +101,10 @@ func SymbolTokenFromString(s string) (Token, error) {
 		return Token{Type: NilToken}, nil
 	}
 
+	if s == "##" {
+		return Token{Type: SymbolToken, String: ""}, nil
+	}
+
 	i, err := strconv.Atoi(s)
 	if err == nil {
 		return Token{Type: NumberToken, String: s, Number: i}, nil
@@ -74,7 +123,7 @@ func (tk *Tokenizer) LastRune(r rune) (bool, error) {
 		r == '(' || r == ')' ||
 		r == '.' || unicode.IsSpace(r) {
 
-		err := tk.r.UnreadRune()
+		err := tk.UnreadRune()
 		if err != nil {
 			return false, err
 		}
@@ -83,18 +132,89 @@ func (tk *Tokenizer) LastRune(r rune) (bool, error) {
 	return false, nil
 }
 
-func (tk *Tokenizer) NextToken() (Token, error) {
+// ReadAtom reads the remainder of a symbol or keyword. A backslash
+// escapes the following rune, which is then taken literally. The
+// second return value reports whether any escape was seen, in which
+// case the atom must not be interpreted as a number, nil or keyword.
+func (tk *Tokenizer) ReadAtom(first rune) (string, bool, error) {
 	buf := make([]rune, 0)
+	escaped := false
+	r := first
+	for {
+		if r == '\\' {
+			next, _, err := tk.ReadRune()
+			if err != nil {
+				return "", false, err
+			}
+			buf = append(buf, next)
+			escaped = true
+		} else if r != 0 {
+			buf = append(buf, r)
+		}
+
+		subr, _, err := tk.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				return string(buf), escaped, nil
+			}
+			return "", false, err
+		}
+
+		isLast, err := tk.LastRune(subr)
+		if err != nil {
+			return "", false, err
+		}
+		if isLast {
+			return string(buf), escaped, nil
+		}
+		r = subr
+	}
+}
 
+func (tk *Tokenizer) NextToken() (Token, error) {
 	r, err := tk.NextRune()
 	if err != nil {
 		if err == io.EOF {
-			return Token{Type: EOFToken}, nil
+			return Token{Type: EOFToken, Pos: tk.pos}, nil
 		}
 		return Token{}, err
 	}
 
+	start := tk.prev
+	token, err := tk.ReadToken(r)
+	if err != nil {
+		return Token{}, err
+	}
+	token.Pos = start
+	return token, nil
+}
+
+// ReadComment reads a comment up to the end of its line, the
+// leading semicolon having already been consumed.
+func (tk *Tokenizer) ReadComment() (Token, error) {
+	buf := []rune{';'}
+	for {
+		r, _, err := tk.ReadRune()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return Token{}, err
+		}
+		if r == '\n' {
+			break
+		}
+		buf = append(buf, r)
+	}
+	return Token{Type: CommentToken, String: strings.TrimRightFunc(string(buf), unicode.IsSpace)}, nil
+}
+
+func (tk *Tokenizer) ReadToken(r rune) (Token, error) {
+	buf := make([]rune, 0)
+
 	switch {
+	case r == ';':
+		return tk.ReadComment()
 	case r == '[':
 		return Token{Type: OpenVectorToken}, nil
 	case r == ']':
@@ -110,12 +230,12 @@ func (tk *Tokenizer) NextToken() (Token, error) {
 	case r == '"':
 		for {
 			escaped := false
-			subr, _, err := tk.r.ReadRune()
+			subr, _, err := tk.ReadRune()
 			if err != nil {
 				return Token{}, err
 			}
 			if subr == '\\' {
-				subr, _, err = tk.r.ReadRune()
+				subr, _, err = tk.ReadRune()
 				if err != nil {
 					return Token{}, err
 				}
@@ -128,47 +248,20 @@ func (tk *Tokenizer) NextToken() (Token, error) {
 		}
 		break
 	case r == ':':
-		for {
-			subr, _, err := tk.r.ReadRune()
-			if err != nil {
-				if err == io.EOF {
-					return Token{Type: KeywordToken, String: string(buf)}, nil
-				}
-				return Token{}, err
-			}
-
-			isLast, err := tk.LastRune(subr)
-			if err != nil {
-				return Token{}, err
-			}
-
-			if isLast {
-				return Token{Type: KeywordToken, String: string(buf)}, nil
-			}
-			buf = append(buf, subr)
+		atom, _, err := tk.ReadAtom(0)
+		if err != nil {
+			return Token{}, err
 		}
-		break
+		return Token{Type: KeywordToken, String: atom}, nil
 	default:
-		buf = append(buf, r)
-		for {
-			subr, _, err := tk.r.ReadRune()
-			if err != nil {
-				if err == io.EOF {
-					return SymbolTokenFromString(string(buf))
-				}
-				return Token{}, err
-			}
-
-			isLast, err := tk.LastRune(subr)
-			if err != nil {
-				return Token{}, err
-			}
-			if isLast {
-				return SymbolTokenFromString(string(buf))
-			}
-			buf = append(buf, subr)
+		atom, escaped, err := tk.ReadAtom(r)
+		if err != nil {
+			return Token{}, err
 		}
-		break
+		if escaped {
+			return Token{Type: SymbolToken, String: atom}, nil
+		}
+		return SymbolTokenFromString(atom)
 	}
 	return Token{}, UnreachableError
 }
@@ -178,8 +271,11 @@ func (tk *Tokenizer) Tokenize() ([]Token, error) {
 
 	for {
 		token, err := tk.NextToken()
+		if err == io.EOF {
+			err = UnexpectedEOFError
+		}
 		if err != nil {
-			return nil, err
+			return nil, &SyntaxError{Pos: tk.pos, Err: err}
 		}
 		if token.Type == EOFToken {
 			return tokens, nil
@@ -193,3 +289,11 @@ func ParseTokens(input []byte) ([]Token, error) {
 	tk := NewTokenizer(input)
 	return tk.Tokenize()
 }
+
+// ParseFileTokens tokenizes the contents of a file, recording its
+// path in the position of every token.
+func ParseFileTokens(path string, input []byte) ([]Token, error) {
+	tk := NewTokenizer(input)
+	tk.pos.File = path
+	return tk.Tokenize()
+}
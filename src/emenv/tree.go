@@ -5,13 +5,30 @@ func NewStack(tokens []Token) Stack {
 }
 
 func (stack *Stack) Parse() (Node, error) {
+	if len(stack.Tokens) == 0 {
+		return Node{}, &SyntaxError{Err: DanglingListError}
+	}
+	pos := stack.Tokens[0].Pos
+	node, err := stack.parse()
+	if err != nil {
+		return Node{}, err
+	}
+	node.Pos = pos
+	return node, nil
+}
+
+func (stack *Stack) parse() (Node, error) {
 
 	head := stack.Tokens[0]
 	stack.Tokens = stack.Tokens[1:]
 
 	switch {
 	case head.Type == QuoteToken:
-		return stack.Parse()
+		quoted, err := stack.Parse()
+		if err != nil {
+			return Node{}, err
+		}
+		return Node{Type: QuoteNode, Children: []Node{quoted}}, nil
 	case head.Type == NumberToken:
 		return Node{Type: NumberNode, Number: head.Number}, nil
 	case head.Type == NilToken:
@@ -27,14 +44,14 @@ func (stack *Stack) Parse() (Node, error) {
 	case head.Type == OpenVectorToken:
 		node := Node{Type: VectorNode}
 		for {
+			if len(stack.Tokens) == 0 {
+				return Node{}, &SyntaxError{Pos: head.Pos, Err: DanglingVectorError}
+			}
 			subhead := stack.Tokens[0]
 			if subhead.Type == CloseVectorToken {
 				stack.Tokens = stack.Tokens[1:]
 				break
 			}
-			if len(stack.Tokens) == 0 {
-				return Node{}, DanglingVectorError
-			}
 			subnode, err := stack.Parse()
 
 			if err != nil {
@@ -46,14 +63,14 @@ func (stack *Stack) Parse() (Node, error) {
 	case head.Type == OpenParToken:
 		node := Node{Type: ListNode}
 		for {
+			if len(stack.Tokens) == 0 {
+				return Node{}, &SyntaxError{Pos: head.Pos, Err: DanglingListError}
+			}
 			subhead := stack.Tokens[0]
 			if subhead.Type == CloseParToken {
 				stack.Tokens = stack.Tokens[1:]
 				break
 			}
-			if len(stack.Tokens) == 0 {
-				return Node{}, DanglingListError
-			}
 			subnode, err := stack.Parse()
 			if err != nil {
 				return Node{}, err
@@ -62,12 +79,12 @@ func (stack *Stack) Parse() (Node, error) {
 		}
 		return node, nil
 	case head.Type == CloseVectorToken:
-		return Node{}, StrayVectorError
+		return Node{}, &SyntaxError{Pos: head.Pos, Err: StrayVectorError}
 	case head.Type == CloseParToken:
-		return Node{}, StrayListError
+		return Node{}, &SyntaxError{Pos: head.Pos, Err: StrayListError}
 
 	default:
-		return Node{}, UnknownTokenError
+		return Node{}, &SyntaxError{Pos: head.Pos, Err: UnknownTokenError}
 	}
 	return Node{}, UnreachableError
 }
@@ -81,10 +98,10 @@ func ParseTree(tokens []Token) (Node, error) {
 	}
 
 	if len(stack.Tokens) > 1 {
-		return Node{}, TrailingTokensError
+		return Node{}, &SyntaxError{Pos: stack.Tokens[0].Pos, Err: TrailingTokensError}
 	}
 	if len(stack.Tokens) == 1 && stack.Tokens[0].Type != EOFToken {
-		return Node{}, TrailingTokensError
+		return Node{}, &SyntaxError{Pos: stack.Tokens[0].Pos, Err: TrailingTokensError}
 	}
 	return node, nil
 }
@@ -2,10 +2,34 @@ package emenv
 
 import (
 	"strings"
+	"time"
 )
 
 type Options struct {
 	ImplicitYes bool
+	Profiles    []string
+	BaseDir     string
+	CacheDir    string
+	CacheSize   int64
+	Offline     bool
+	Bundle      string
+	Timeout     time.Duration
+	Retries     int
+	CABundle    string
+	// How long to wait for another process changing the environment:
+	// not at all when zero, indefinitely when negative.
+	LockWait time.Duration
+	// ServePrivate lets emenv serve expose sources which require
+	// authentication, which it otherwise leaves out.
+	ServePrivate bool
+	// Update moves git packages to the commit their ref points to,
+	// rather than keeping the commit previously installed.
+	Update bool
+	// Events are reported to Observer and questions asked to
+	// Prompter; without them emenv is silent and declines to go on
+	// unless ImplicitYes is set.
+	Observer Observer
+	Prompter Prompter
 }
 
 type TokenType int
@@ -23,16 +47,27 @@ const (
 	QuoteToken
 	NilToken
 	EOFToken
+	CommentToken
 )
 
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
 type Token struct {
 	Type   TokenType
 	Number int
 	String string
+	Pos    Position
 }
 
 type Tokenizer struct {
-	r *strings.Reader
+	r        *strings.Reader
+	pos      Position
+	prev     Position
+	comments bool
 }
 
 type NodeType int
@@ -48,6 +83,7 @@ const (
 	NumberNode
 	NilNode
 	EOFNode
+	QuoteNode
 )
 
 type Node struct {
@@ -55,6 +91,7 @@ type Node struct {
 	Number   int
 	String   string
 	Children []Node
+	Pos      Position
 }
 
 type Stack struct {
@@ -71,6 +108,8 @@ type StorageType int
 const (
 	FileStorage StorageType = iota
 	TarStorage
+	LinkStorage
+	GitStorage
 )
 
 type PackageDef struct {
@@ -78,6 +117,30 @@ type PackageDef struct {
 	Repo    string
 	Type    PackageType
 	Version Version
+	Pos     Position
+	Path    string
+	Git     string
+	Ref     string
+	Recipe  *Recipe
+	// Constraints given with the version option of the Emenv file
+	Constraints []VersionConstraint
+}
+
+// A VersionConstraint bounds the acceptable versions of a package, Op
+// being one of >=, >, <=, < and =.
+type VersionConstraint struct {
+	Op      string
+	Version Version
+}
+
+// A Requirement is what package By, or the Emenv file at Pos when By
+// is empty, requires of package Name.
+type Requirement struct {
+	Name        string
+	By          string
+	ByVersion   string
+	Pos         Position
+	Constraints []VersionConstraint
 }
 
 type PackageType int
@@ -91,6 +154,15 @@ const (
 	DependencyPackage
 )
 
+type Recipe struct {
+	Name    string
+	Fetcher string
+	URL     string
+	Branch  string
+	Commit  string
+	Files   []Node
+}
+
 type Package struct {
 	Name         string
 	Version      Version
@@ -98,6 +170,7 @@ type Package struct {
 	Type         StorageType
 	URL          string
 	Dependencies []PackageDef
+	Commit       string
 }
 
 type Repository struct {
@@ -108,8 +181,12 @@ type Repository struct {
 }
 
 type Source struct {
-	Name string
-	URL  string
+	Name    string
+	URL     string
+	Mirrors []string
+	Timeout time.Duration
+	Auth    *SourceAuth
+	Pos     Position
 }
 
 type SourceConfig struct {
@@ -128,6 +205,9 @@ type InstallDef struct {
 	StoreType StorageType
 	Depth     int
 	Parent    *InstallNode
+	Path      string
+	Commit    string
+	Ref       string
 }
 
 type InstallNode struct {
@@ -138,6 +218,7 @@ type InstallNode struct {
 type InstallSet struct {
 	Tree     InstallNode
 	Packages map[string]InstallDef
+	Resolved map[string]Package
 }
 
 type Upgrade struct {
@@ -159,10 +240,29 @@ type Env struct {
 	Packages     []PackageDef
 	Sources      map[string]Source
 	Prefer       []string
+	PreferPos    Position
 	Previous     map[string]InstallDef
 	Provided     []string
 	Repositories map[string]Repository
 	InstallSet   InstallSet
 	DiffSet      DiffSet
 	Options      Options
+	Warnings     []Problem
+	// Problems met while reading the Emenv file, reported along
+	// with those Validate finds
+	ConfigProblems []Problem
+	Loading      []string
+	Cache        Cache
+	Unavailable  []string
+	Mirrors      map[string]*MirrorStatus
+	Client       *Client
+	Fetcher      Fetcher
+	Observer     Observer
+	Prompter     Prompter
+}
+
+type Problem struct {
+	Pos     Position
+	Message string
+	Warning bool
 }
@@ -0,0 +1,127 @@
+package emenv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sameOrigin tells whether two declarations of a package take it from
+// the same place: the same source, path, git URL and ref, or recipe.
+func sameOrigin(a PackageDef, b PackageDef) bool {
+
+	if a.Repo != b.Repo || a.Path != b.Path || a.Git != b.Git || a.Ref != b.Ref {
+		return false
+	}
+	if a.Recipe == nil || b.Recipe == nil {
+		return a.Recipe == b.Recipe
+	}
+	ra, rb := a.Recipe, b.Recipe
+	return ra.Fetcher == rb.Fetcher && ra.URL == rb.URL && ra.Branch == rb.Branch &&
+		ra.Commit == rb.Commit && PrintNode(NewList(ra.Files...)) == PrintNode(NewList(rb.Files...))
+}
+
+func newProblem(pos Position, warning bool, format string, args ...interface{}) Problem {
+	return Problem{Pos: pos, Warning: warning, Message: fmt.Sprintf(format, args...)}
+}
+
+// Validate inspects a loaded configuration for mistakes which would
+// otherwise only surface while resolving, or never. It must run
+// before unlisted sources are appended to the preference order.
+func (env *Env) Validate() []Problem {
+
+	problems := make([]Problem, 0)
+	used := make(map[string]bool)
+
+	for _, name := range env.Prefer {
+		if _, ok := env.Sources[name]; !ok {
+			problems = append(problems, newProblem(env.PreferPos, false,
+				"prefer names undefined source %s", name))
+		}
+		used[name] = true
+	}
+
+	seen := make(map[string]PackageDef)
+	for _, pdef := range env.Packages {
+		origins := 0
+		for _, origin := range []string{pdef.Repo, pdef.Path, pdef.Git} {
+			if len(origin) > 0 {
+				origins++
+			}
+		}
+		if origins > 1 {
+			problems = append(problems, newProblem(pdef.Pos, false,
+				"package %s must have only one of a repository, a path or a git URL", pdef.Name))
+		}
+		if len(pdef.Repo) > 0 {
+			used[pdef.Repo] = true
+			if _, ok := env.Sources[pdef.Repo]; !ok {
+				problems = append(problems, newProblem(pdef.Pos, false,
+					"package %s uses undefined source %s", pdef.Name, pdef.Repo))
+			}
+		}
+		for _, pv := range env.Provided {
+			if pv == pdef.Name {
+				problems = append(problems, newProblem(pdef.Pos, false,
+					"package %s is also listed as provided", pdef.Name))
+			}
+		}
+		if prev, ok := seen[pdef.Name]; ok {
+			if !sameOrigin(prev, pdef) {
+				problems = append(problems, newProblem(pdef.Pos, false,
+					"package %s already declared at %s with a different origin",
+					pdef.Name, prev.Pos))
+			} else {
+				problems = append(problems, newProblem(pdef.Pos, true,
+					"package %s already declared at %s", pdef.Name, prev.Pos))
+			}
+			continue
+		}
+		seen[pdef.Name] = pdef
+	}
+
+	names := make([]string, 0)
+	for name, _ := range env.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src := env.Sources[name]
+		// Built-in sources carry no position and are never reported.
+		// Without a prefer directive, every source is tried in turn.
+		if src.Pos.Line == 0 || used[name] || env.PreferPos.Line == 0 {
+			continue
+		}
+		problems = append(problems, newProblem(src.Pos, true,
+			"source %s is missing from prefer, and only tried after the sources it lists", name))
+	}
+
+	return SortProblems(problems)
+}
+
+// SortProblems orders problems by file and position.
+func SortProblems(problems []Problem) []Problem {
+	sort.SliceStable(problems, func(i, j int) bool {
+		pi, pj := problems[i].Pos, problems[j].Pos
+		if pi.File != pj.File {
+			return pi.File < pj.File
+		}
+		return pi.Line < pj.Line || (pi.Line == pj.Line && pi.Column < pj.Column)
+	})
+	return problems
+}
+
+// configProblem turns an error met while reading a directive into a
+// problem, when it points at the offending place.
+func configProblem(err error) (Problem, bool) {
+	var serr *SyntaxError
+	var oerr *OptionError
+	switch {
+	case errors.As(err, &serr) && serr.Pos.Line > 0:
+		return newProblem(serr.Pos, false, "%s", serr.Err), true
+	case errors.As(err, &oerr):
+		return newProblem(oerr.Pos, false, "%s", strings.TrimPrefix(oerr.Error(), oerr.Pos.String()+": ")), true
+	}
+	return Problem{}, false
+}